@@ -0,0 +1,277 @@
+// Command migratechats copies the legacy per-user chats documents, which
+// embed every message in an array, into the conversations and messages
+// collections.
+//
+// Every write is an idempotent upsert and progress is saved after each user,
+// so an interrupted run can simply be started again. Use -restart to go over
+// all users from the beginning, e.g. to pick up messages the old code added
+// after a user was migrated.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"my-work/config"
+	"my-work/controllers"
+	"my-work/models"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const migrationID = "chats_to_messages"
+
+// legacyChats is one user's document in the chats collection
+type legacyChats struct {
+	ID      interface{}  `bson:"_id"`
+	User_ID string       `bson:"user_id"`
+	Chats   []legacyChat `bson:"chats"`
+}
+
+// legacyChat is the user's chat with Sub_ID
+type legacyChat struct {
+	Sub_ID   string           `bson:"sub_id"`
+	Messages []models.Message `bson:"messages"`
+}
+
+// migrationProgress is stored in the migrations collection
+type migrationProgress struct {
+	ID           string      `bson:"_id"`
+	Last_ID      interface{} `bson:"last_id,omitempty"`
+	Users        int         `bson:"users"`
+	Messages     int         `bson:"messages"`
+	Updated_At   time.Time   `bson:"updated_at"`
+	Completed_At *time.Time  `bson:"completed_at,omitempty"`
+}
+
+func main() {
+	restart := flag.Bool("restart", false, "ignore saved progress and migrate every user again")
+	dryRun := flag.Bool("dry-run", false, "count what would be migrated without writing")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: Could not load .env file: %v", err)
+	}
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017"
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	if !*dryRun {
+		if err := controllers.EnsureChatIndexes(&config.AppConfig{Client: client}); err != nil {
+			log.Fatalf("Failed to create chat indexes: %v", err)
+		}
+	}
+	if err := migrate(client.Database("talkmore"), *restart, *dryRun); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+}
+
+func migrate(db *mongo.Database, restart, dryRun bool) error {
+	ctx := context.Background()
+	progressCollection := db.Collection("migrations")
+
+	progress := migrationProgress{ID: migrationID}
+	if !restart {
+		err := progressCollection.FindOne(ctx, bson.M{"_id": migrationID}).Decode(&progress)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return fmt.Errorf("load progress: %w", err)
+		}
+		if progress.Last_ID != nil {
+			log.Printf("Resuming after chats document %v (%d users, %d messages so far)", progress.Last_ID, progress.Users, progress.Messages)
+		}
+	}
+
+	filter := bson.M{}
+	if progress.Last_ID != nil {
+		filter["_id"] = bson.M{"$gt": progress.Last_ID}
+	}
+	cursor, err := db.Collection("chats").Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("read chats: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc legacyChats
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("decode chats document: %w", err)
+		}
+		count, err := migrateUser(ctx, db, doc, dryRun)
+		if err != nil {
+			return fmt.Errorf("migrate user %s: %w", doc.User_ID, err)
+		}
+
+		progress.Last_ID = doc.ID
+		progress.Users++
+		progress.Messages += count
+		progress.Updated_At = time.Now()
+		if !dryRun {
+			if err := saveProgress(ctx, progressCollection, progress); err != nil {
+				return err
+			}
+		}
+		log.Printf("Migrated %d messages of user %s", count, doc.User_ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("read chats: %w", err)
+	}
+
+	now := time.Now()
+	progress.Completed_At = &now
+	if !dryRun {
+		if err := saveProgress(ctx, progressCollection, progress); err != nil {
+			return err
+		}
+	}
+	log.Printf("Done: %d users, %d messages", progress.Users, progress.Messages)
+	return nil
+}
+
+// migrateUser writes the messages of every chat in doc and brings the
+// matching conversations up to date. Both users of a chat hold a copy of
+// each message under the same message_id, so the second copy is a no-op.
+func migrateUser(ctx context.Context, db *mongo.Database, doc legacyChats, dryRun bool) (int, error) {
+	chats, skipped := chatsToMigrate(doc)
+	if skipped > 0 {
+		log.Printf("Skipped %d messages user %s received under their own id; the senders' copies are migrated", skipped, doc.User_ID)
+	}
+
+	total := 0
+	for _, chat := range chats {
+		conversationID := models.ConversationID(doc.User_ID, chat.Sub_ID)
+
+		writes := make([]mongo.WriteModel, 0, len(chat.Messages))
+		var first, last models.ChatMessage
+		for i, legacy := range chat.Messages {
+			message := convertMessage(doc.User_ID, chat.Sub_ID, conversationID, legacy)
+			if i == 0 || message.Date.Before(first.Date) {
+				first = message
+			}
+			if i == 0 || !message.Date.Before(last.Date) {
+				last = message
+			}
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": message.ID}).
+				SetUpdate(bson.M{"$setOnInsert": bson.M{
+					"conversation_id": message.Conversation_ID,
+					"sender_id":       message.Sender_ID,
+					"recipient_id":    message.Recipient_ID,
+					"message":         message.Message,
+					"date":            message.Date,
+				}}).
+				SetUpsert(true))
+		}
+		total += len(writes)
+		if dryRun {
+			continue
+		}
+
+		if _, err := db.Collection("messages").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return total, fmt.Errorf("write messages: %w", err)
+		}
+
+		conversations := db.Collection("conversations")
+		_, err := conversations.UpdateOne(ctx,
+			bson.M{"_id": conversationID},
+			bson.M{
+				"$setOnInsert": bson.M{"participants": []string{doc.User_ID, chat.Sub_ID}},
+				"$min":         bson.M{"created_at": first.Date},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return total, fmt.Errorf("write conversation: %w", err)
+		}
+		// Only move the last message forward, never back to an older one.
+		// Legacy chats had no unread state, so migrated history counts as
+		// read by both sides.
+		cursor := models.ReadCursor{Message_ID: last.ID, Message_Date: last.Date, Read_At: time.Now().UTC()}
+		_, err = conversations.UpdateOne(ctx,
+			bson.M{"_id": conversationID, "$or": []bson.M{
+				{"last_message_at": bson.M{"$exists": false}},
+				{"last_message_at": bson.M{"$lt": last.Date}},
+			}},
+			bson.M{"$set": bson.M{
+				"last_message":                last.Message,
+				"last_message_id":             last.ID,
+				"last_sender_id":              last.Sender_ID,
+				"last_message_at":             last.Date,
+				"read_cursors." + doc.User_ID: cursor,
+				"read_cursors." + chat.Sub_ID: cursor,
+			}},
+		)
+		if err != nil {
+			return total, fmt.Errorf("write conversation: %w", err)
+		}
+	}
+	return total, nil
+}
+
+// chatsToMigrate returns the chats of doc worth migrating and how many
+// messages it left out.
+//
+// When someone wrote to a user who had no chat with them yet, the old code
+// filed the recipient's copy under a new chat whose sub_id was the
+// recipient's own id, one chat per message. Migrating those would create
+// u:u conversations. Every such message also sits in the sender's chat with
+// the recipient under the same message_id, so they are skipped.
+func chatsToMigrate(doc legacyChats) ([]legacyChat, int) {
+	chats := make([]legacyChat, 0, len(doc.Chats))
+	skipped := 0
+	for _, chat := range doc.Chats {
+		switch {
+		case chat.Sub_ID == "" || len(chat.Messages) == 0:
+		case chat.Sub_ID == doc.User_ID:
+			skipped += len(chat.Messages)
+		default:
+			chats = append(chats, chat)
+		}
+	}
+	return chats, skipped
+}
+
+// convertMessage turns a message from userID's chat with subID into a
+// messages document. Legacy messages always carry the recipient in
+// destination, in both users' copies.
+func convertMessage(userID, subID, conversationID string, legacy models.Message) models.ChatMessage {
+	message := models.ChatMessage{
+		ID:              legacy.MessageId,
+		Conversation_ID: conversationID,
+		Sender_ID:       userID,
+		Recipient_ID:    subID,
+		Message:         legacy.Message,
+		Date:            legacy.Date,
+	}
+	if legacy.Destination == userID {
+		message.Sender_ID, message.Recipient_ID = subID, userID
+	}
+	// Very old messages have no id; derive one both copies agree on
+	if message.ID == "" {
+		sum := sha256.Sum256([]byte(conversationID + "|" + message.Sender_ID + "|" + message.Date.UTC().Format(time.RFC3339Nano) + "|" + message.Message))
+		message.ID = hex.EncodeToString(sum[:12])
+	}
+	return message
+}
+
+func saveProgress(ctx context.Context, collection *mongo.Collection, progress migrationProgress) error {
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": progress.ID}, progress, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("save progress: %w", err)
+	}
+	return nil
+}
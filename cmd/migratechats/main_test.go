@@ -0,0 +1,128 @@
+package main
+
+import (
+	"my-work/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// legacyFixtures returns the chats documents the old SaveMessageByUserId
+// left behind when a1 wrote to b1 twice, b1 replied and a1 wrote again.
+// b1 had no chat with a1 for the first two, so their copies were filed
+// under b1's own id, one chat each. The recipient's copy carries the
+// sender's name and email.
+func legacyFixtures() (a, b legacyChats) {
+	at := func(minute int) time.Time {
+		return time.Date(2024, 3, 1, 12, minute, 0, 0, time.UTC)
+	}
+	toB := func(id, text string, minute int, copyOf string) models.Message {
+		m := models.Message{MessageId: id, Destination: "b1", Message: text, Date: at(minute), Name: "Bea Baker", Email: "bea@example.com"}
+		if copyOf == "recipient" {
+			m.Name, m.Email = "Al Able", "al@example.com"
+		}
+		return m
+	}
+	toA := func(id, text string, minute int, copyOf string) models.Message {
+		m := models.Message{MessageId: id, Destination: "a1", Message: text, Date: at(minute), Name: "Al Able", Email: "al@example.com"}
+		if copyOf == "recipient" {
+			m.Name, m.Email = "Bea Baker", "bea@example.com"
+		}
+		return m
+	}
+
+	a = legacyChats{ID: "doc-a", User_ID: "a1", Chats: []legacyChat{
+		{Sub_ID: "b1", Messages: []models.Message{
+			toB("m1", "hi", 1, "sender"),
+			toB("m2", "are you there?", 2, "sender"),
+			toA("m3", "yes", 3, "recipient"),
+			toB("", "great", 4, "sender"),
+		}},
+	}}
+	b = legacyChats{ID: "doc-b", User_ID: "b1", Chats: []legacyChat{
+		{Sub_ID: "b1", Messages: []models.Message{toB("m1", "hi", 1, "recipient")}},
+		{Sub_ID: "b1", Messages: []models.Message{toB("m2", "are you there?", 2, "recipient")}},
+		{Sub_ID: "a1", Messages: []models.Message{
+			toA("m3", "yes", 3, "sender"),
+			toB("", "great", 4, "recipient"),
+		}},
+	}}
+	return a, b
+}
+
+func TestChatsToMigrate(t *testing.T) {
+	a, b := legacyFixtures()
+	tests := []struct {
+		doc     legacyChats
+		subIDs  []string
+		skipped int
+	}{
+		{a, []string{"b1"}, 0},
+		{b, []string{"a1"}, 2},
+		{legacyChats{User_ID: "c1", Chats: []legacyChat{{Sub_ID: ""}, {Sub_ID: "a1"}}}, nil, 0},
+	}
+	for _, tt := range tests {
+		chats, skipped := chatsToMigrate(tt.doc)
+		var subIDs []string
+		for _, chat := range chats {
+			subIDs = append(subIDs, chat.Sub_ID)
+		}
+		if len(subIDs) != len(tt.subIDs) || skipped != tt.skipped {
+			t.Errorf("chatsToMigrate(%s) = %v, %d skipped; want %v, %d", tt.doc.User_ID, subIDs, skipped, tt.subIDs, tt.skipped)
+			continue
+		}
+		for i := range subIDs {
+			if subIDs[i] != tt.subIDs[i] {
+				t.Errorf("chatsToMigrate(%s) = %v, want %v", tt.doc.User_ID, subIDs, tt.subIDs)
+			}
+		}
+	}
+}
+
+func TestConvertMessage(t *testing.T) {
+	a, b := legacyFixtures()
+	conversationID := models.ConversationID("a1", "b1")
+
+	// Convert what the migration would write from both documents
+	converted := map[string][]models.ChatMessage{}
+	var order []string
+	for _, doc := range []legacyChats{a, b} {
+		chats, _ := chatsToMigrate(doc)
+		for _, chat := range chats {
+			if id := models.ConversationID(doc.User_ID, chat.Sub_ID); id != conversationID {
+				t.Fatalf("%s's chat with %s maps to conversation %s", doc.User_ID, chat.Sub_ID, id)
+			}
+			for _, legacy := range chat.Messages {
+				m := convertMessage(doc.User_ID, chat.Sub_ID, conversationID, legacy)
+				if converted[m.ID] == nil {
+					order = append(order, m.ID)
+				}
+				converted[m.ID] = append(converted[m.ID], m)
+			}
+		}
+	}
+
+	wantSenders := []string{"a1", "a1", "b1", "a1"}
+	if len(order) != len(wantSenders) {
+		t.Fatalf("converted %d distinct messages, want %d: %v", len(order), len(wantSenders), order)
+	}
+	for i, id := range order {
+		copies := converted[id]
+		first := copies[0]
+		if first.Sender_ID != wantSenders[i] {
+			t.Errorf("message %s sender = %s, want %s", id, first.Sender_ID, wantSenders[i])
+		}
+		if first.Recipient_ID == first.Sender_ID || first.Conversation_ID != conversationID {
+			t.Errorf("message %s = %+v", id, first)
+		}
+		// Both users' copies, including the derived id, must agree
+		for _, other := range copies[1:] {
+			if !reflect.DeepEqual(other, first) {
+				t.Errorf("copies of %s differ: %+v vs %+v", id, first, other)
+			}
+		}
+	}
+	if copies := converted[order[3]]; len(copies) != 2 || len(order[3]) != 24 {
+		t.Errorf("message without id: %d copies under derived id %q", len(copies), order[3])
+	}
+}
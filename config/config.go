@@ -2,9 +2,20 @@ package config
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"my-work/hub"
+	"my-work/keyring"
+	"my-work/mailer"
+	"my-work/oidc"
+	"my-work/passwordpolicy"
+	"my-work/principal"
+	"my-work/pubsub"
+	"my-work/sms"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -15,10 +26,34 @@ import (
 
 // AppConfig holds application-wide configuration
 type AppConfig struct {
-	Client         *mongo.Client
-	SecretKey      []byte
-	RequireDBCheck bool
-	Validator      *validator.Validate
+	Client    *mongo.Client
+	SecretKey []byte
+	Validator *validator.Validate
+	Mailer    mailer.Mailer
+	SMS       sms.SMSSender
+	// Keyring signs JWTs with RS256/EdDSA. When nil, tokens are signed
+	// with HS256 and SecretKey.
+	Keyring *keyring.Keyring
+	// LegacyHS256Until is when tokens signed with SecretKey stop being
+	// accepted once a Keyring is configured. Zero rejects them outright.
+	LegacyHS256Until time.Time
+	// AccountDeletionGrace is how long a deleted account can still be
+	// restored by signing in before it is purged
+	AccountDeletionGrace time.Duration
+	// MagicLinkURL is the page that receives sign-in links as ?token=
+	// and posts the token to /signin/magiclink/exchange
+	MagicLinkURL string
+	// OIDCProviders are the "Sign in with ..." providers, keyed by name
+	OIDCProviders map[string]*oidc.Provider
+	// PasswordPolicy is checked whenever a password is set
+	PasswordPolicy *passwordpolicy.Policy
+	// Principals caches the authenticated user per session for the
+	// auth middleware
+	Principals *principal.Cache
+	// Hub delivers WebSocket events to the connections of this instance
+	// through PubSub, which also tracks presence across instances
+	Hub    *hub.Hub
+	PubSub pubsub.PubSub
 }
 
 // Init initializes the application configuration
@@ -51,13 +86,334 @@ func Init() (*AppConfig, error) {
 		return nil, fmt.Errorf("SECRET_KEY not set in environment")
 	}
 
+	// Load asymmetric JWT keys, if configured
+	var keys *keyring.Keyring
+	if activeKey := os.Getenv("JWT_SIGNING_KEY_FILE"); activeKey != "" {
+		var retired []string
+		for _, path := range strings.Split(os.Getenv("JWT_RETIRED_KEY_FILES"), ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				retired = append(retired, path)
+			}
+		}
+		keys, err = keyring.Load(activeKey, retired)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT keys: %v", err)
+		}
+		log.Printf("Signing JWTs with %s key %s", keys.Active().Method.Alg(), keys.Active().ID)
+	}
+
+	// Tokens signed with SECRET_KEY before the switch to a keyring can be
+	// honoured until this RFC 3339 time
+	var legacyHS256Until time.Time
+	if raw := os.Getenv("JWT_LEGACY_HS256_UNTIL"); raw != "" {
+		legacyHS256Until, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_LEGACY_HS256_UNTIL: %v", err)
+		}
+	}
+
+	deletionGrace, err := envDuration("ACCOUNT_DELETION_GRACE", 14*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	magicLinkURL := os.Getenv("MAGIC_LINK_URL")
+	if magicLinkURL == "" {
+		magicLinkURL = "http://localhost:3000/magic-link"
+	}
+
+	providers, err := loadOIDCProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := loadPasswordPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheSize, err := envInt("PRINCIPAL_CACHE_SIZE", 10000)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := envDuration("PRINCIPAL_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	sendQueue, err := envInt("WS_SEND_QUEUE_SIZE", 64)
+	if err != nil {
+		return nil, err
+	}
+	events, err := newPubSub(client)
+	if err != nil {
+		return nil, err
+	}
+	socketHub, err := hub.New(sendQueue, events)
+	if err != nil {
+		return nil, err
+	}
+	principals := principal.NewCache(cacheSize, cacheTTL)
+	shareInvalidations(principals, socketHub)
+
 	// Initialize validator
 	validate := validator.New()
 
+	// Initialize mailer
+	mail, err := newMailer()
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize SMS sender
+	textSender, err := newSMSSender()
+	if err != nil {
+		return nil, err
+	}
+
 	return &AppConfig{
-		Client:         client,
-		SecretKey:      []byte(secretKey),
-		RequireDBCheck: os.Getenv("REQUIRE_DB_CHECK") == "true",
-		Validator:      validate,
+		Client:    client,
+		SecretKey: []byte(secretKey),
+		Validator: validate,
+		Mailer:    mail,
+		SMS:       textSender,
+		Keyring:   keys,
+
+		LegacyHS256Until:     legacyHS256Until,
+		AccountDeletionGrace: deletionGrace,
+		MagicLinkURL:         magicLinkURL,
+		OIDCProviders:        providers,
+		PasswordPolicy:       policy,
+		Principals:           principals,
+		Hub:                  socketHub,
+		PubSub:               events,
 	}, nil
 }
+
+// newMailer picks the mail backend from MAIL_BACKEND ("smtp" or "spool").
+// The backend has to be named so a deployment can't quietly spool mail to
+// disk instead of sending it.
+func newMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "talkmore <no-reply@talkmore.local>"
+	}
+
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST not set in environment")
+		}
+		port, err := envInt("SMTP_PORT", 587)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := envDuration("SMTP_TIMEOUT", 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Host:       host,
+			Port:       port,
+			Username:   os.Getenv("SMTP_USERNAME"),
+			Password:   os.Getenv("SMTP_PASSWORD"),
+			From:       from,
+			Timeout:    timeout,
+			RequireTLS: os.Getenv("SMTP_REQUIRE_TLS") != "false",
+		}), nil
+	case "":
+		return nil, fmt.Errorf("MAIL_BACKEND is not set; set it to \"smtp\", or to \"spool\" to write mail to disk instead of sending it")
+	case "spool":
+		dir := os.Getenv("MAIL_SPOOL_DIR")
+		if dir == "" {
+			dir = "mailspool"
+		}
+		log.Printf("WARNING: Mail backend: mail, one-time codes included, is not sent but spooled to %s", dir)
+		return mailer.NewSpoolMailer(dir, from)
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+// newPubSub picks the WebSocket event backend from PUBSUB_BACKEND:
+// "memory" (the default) for a single instance, or "mongo" to share events
+// between instances through a capped collection of PUBSUB_EVENTS_SIZE bytes.
+func newPubSub(client *mongo.Client) (pubsub.PubSub, error) {
+	switch backend := os.Getenv("PUBSUB_BACKEND"); backend {
+	case "", "memory":
+		return pubsub.NewMemory(), nil
+	case "mongo":
+		size, err := envInt("PUBSUB_EVENTS_SIZE", 64<<20)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		events, err := pubsub.NewMongo(ctx, client.Database("talkmore"), "socketEvents", int64(size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up mongo pubsub: %v", err)
+		}
+		log.Printf("PubSub backend: sharing WebSocket events through MongoDB")
+		return events, nil
+	default:
+		return nil, fmt.Errorf("unknown PUBSUB_BACKEND %q", backend)
+	}
+}
+
+// principalInvalidation is the hub broadcast kind for principal cache
+// invalidations
+const principalInvalidation = "principal_invalidation"
+
+// shareInvalidations sends the cache's invalidations to every instance
+// through the hub, so a revoked session or changed role stops being served
+// everywhere rather than after the cache TTL
+func shareInvalidations(cache *principal.Cache, socketHub *hub.Hub) {
+	socketHub.HandleBroadcast(principalInvalidation, func(payload []byte) {
+		var inv principal.Invalidation
+		if err := json.Unmarshal(payload, &inv); err != nil {
+			log.Printf("Ignoring malformed principal invalidation: %v", err)
+			return
+		}
+		cache.Apply(inv)
+	})
+	cache.OnInvalidate(func(inv principal.Invalidation) {
+		payload, err := json.Marshal(inv)
+		if err == nil {
+			err = socketHub.Broadcast(principalInvalidation, payload)
+		}
+		if err != nil {
+			log.Printf("Failed to share invalidation of user %s: %v", inv.User_ID, err)
+		}
+	})
+}
+
+// newSMSSender picks the SMS backend from SMS_BACKEND. Only "log" is built
+// in: it appends messages to SMS_LOG_FILE, or the server log when unset. The
+// backend has to be named so a deployment can't quietly log one-time codes
+// instead of texting them.
+func newSMSSender() (sms.SMSSender, error) {
+	switch backend := os.Getenv("SMS_BACKEND"); backend {
+	case "":
+		return nil, fmt.Errorf("SMS_BACKEND is not set; set it to \"log\" to log text messages instead of sending them")
+	case "log":
+		path := os.Getenv("SMS_LOG_FILE")
+		destination := path
+		if destination == "" {
+			destination = "the server log"
+		}
+		log.Printf("WARNING: SMS backend: text messages, one-time codes included, are not sent but written to %s", destination)
+		return sms.NewLogSender(path), nil
+	default:
+		return nil, fmt.Errorf("unknown SMS_BACKEND %q", backend)
+	}
+}
+
+// loadOIDCProviders reads OIDC_PROVIDERS (comma-separated names) and for each
+// name the OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and
+// optional _SCOPES variables
+func loadOIDCProviders() (map[string]*oidc.Provider, error) {
+	providers := map[string]*oidc.Provider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %s needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Fields(scopes)
+		}
+		providers[name] = oidc.NewProvider(cfg)
+	}
+	return providers, nil
+}
+
+// loadPasswordPolicy reads the PASSWORD_* rules and the optional
+// BREACHED_PASSWORDS_DIR of HIBP range files
+func loadPasswordPolicy() (*passwordpolicy.Policy, error) {
+	policy := &passwordpolicy.Policy{}
+	var err error
+	if policy.MinLength, err = envInt("PASSWORD_MIN_LENGTH", 8); err != nil {
+		return nil, err
+	}
+	if policy.MaxLength, err = envInt("PASSWORD_MAX_LENGTH", 64); err != nil {
+		return nil, err
+	}
+	rules := []struct {
+		key  string
+		def  bool
+		dest *bool
+	}{
+		{"PASSWORD_REQUIRE_UPPER", false, &policy.RequireUpper},
+		{"PASSWORD_REQUIRE_LOWER", false, &policy.RequireLower},
+		{"PASSWORD_REQUIRE_DIGIT", false, &policy.RequireDigit},
+		{"PASSWORD_REQUIRE_SYMBOL", false, &policy.RequireSymbol},
+		{"PASSWORD_DISALLOW_PERSONAL", true, &policy.DisallowPersonal},
+	}
+	for _, rule := range rules {
+		if *rule.dest, err = envBool(rule.key, rule.def); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		minCount, err := envInt("BREACHED_PASSWORDS_MIN_COUNT", 1)
+		if err != nil {
+			return nil, err
+		}
+		if policy.Breached, err = passwordpolicy.NewBreachedList(dir, minCount); err != nil {
+			return nil, err
+		}
+		log.Printf("Checking new passwords against breached hashes in %s", dir)
+	}
+	return policy, nil
+}
+
+// envInt reads an integer environment variable, falling back to def when unset
+func envInt(key string, def int) (int, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// envDuration reads a time.ParseDuration value, falling back to def when unset
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// envBool reads a strconv.ParseBool value, falling back to def when unset
+func envBool(key string, def bool) (bool, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return value, nil
+}
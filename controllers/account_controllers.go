@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"my-work/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeletedUserName is shown instead of a purged user's name in other people's
+// chats
+const DeletedUserName = "Deleted user"
+
+// DeleteAccount schedules the account for deletion after the grace period
+// and signs it out everywhere. Signing in again before then restores it.
+func DeleteAccount(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.DeleteAccount
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if !confirmIdentity(ctx, mctx, app, user, req.Password) {
+			return
+		}
+
+		now := time.Now()
+		scheduledFor := now.Add(app.AccountDeletionGrace)
+		_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID},
+			bson.M{"$set": bson.M{
+				"deletion_requested_at":  now,
+				"deletion_scheduled_for": scheduledFor,
+				"updated_at":             now,
+			}},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to delete account", err.Error())
+			return
+		}
+		if err := token.RevokeAllSessions(mctx, app, user.User_ID); err != nil {
+			log.Printf("Failed to revoke sessions of deleted user %s: %v", user.User_ID, err)
+		}
+		if err := revokeAllAPIKeys(mctx, app, user.User_ID); err != nil {
+			log.Printf("Failed to revoke API keys of deleted user %s: %v", user.User_ID, err)
+		}
+
+		SuccessResponse(ctx, "Account scheduled for deletion", gin.H{
+			"deletion_scheduled_for": scheduledFor,
+		})
+	}
+}
+
+// errAccountDeleted is returned when a sign-in races the end of the
+// account's deletion grace period
+var errAccountDeleted = errors.New("account has been deleted")
+
+// restoreDeletedAccount cancels a pending deletion when the user signs in
+// during the grace period. Once the grace period is over the account can't
+// be restored, even if the purger hasn't got to it yet.
+func restoreDeletedAccount(mctx context.Context, app *config.AppConfig, user models.SetSignUpModel) error {
+	if user.Deletion_Scheduled_For == nil {
+		return nil
+	}
+	result, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+		bson.M{"user_id": user.User_ID, "deletion_scheduled_for": bson.M{"$gt": time.Now()}},
+		bson.M{
+			"$unset": bson.M{"deletion_requested_at": "", "deletion_scheduled_for": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errAccountDeleted
+	}
+	log.Printf("Account %s restored by sign-in during deletion grace period", user.User_ID)
+	return nil
+}
+
+// isPastDeletion reports whether the account's grace period has run out and
+// it is only waiting to be purged
+func isPastDeletion(user models.SetSignUpModel) bool {
+	return user.Deletion_Scheduled_For != nil && time.Now().After(*user.Deletion_Scheduled_For)
+}
+
+// purgeLease is held while purging so replicas don't race the same purge;
+// it outlives the longest run
+const (
+	purgeLease    = "account_purger"
+	purgeLeaseTTL = 30 * time.Minute
+)
+
+// leaseHolder identifies this instance in the leases collection
+var leaseHolder = primitive.NewObjectID().Hex()
+
+// StartAccountPurger periodically purges accounts whose grace period is over
+// and export archives whose download link has expired. Only the instance
+// holding the purge lease runs each round.
+func StartAccountPurger(app *config.AppConfig, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if acquireLease(app, purgeLease, purgeLeaseTTL) {
+				PurgeDeletedAccounts(app)
+				PurgeExpiredExports(app)
+				releaseLease(app, purgeLease)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// acquireLease takes the named lease for ttl unless another instance holds
+// it. Taking an expired lease is allowed.
+func acquireLease(app *config.AppConfig, name string, ttl time.Duration) bool {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := app.Client.Database("talkmore").Collection("leases").UpdateOne(mctx,
+		bson.M{"_id": name, "$or": []bson.M{
+			{"holder": leaseHolder},
+			{"expires_at": bson.M{"$lte": now}},
+		}},
+		bson.M{"$set": bson.M{"holder": leaseHolder, "expires_at": now.Add(ttl)}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		// The upsert collides with the live lease of another instance
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Printf("Failed to acquire %s lease: %v", name, err)
+		}
+		return false
+	}
+	return true
+}
+
+// releaseLease gives up the named lease if this instance still holds it
+func releaseLease(app *config.AppConfig, name string) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := app.Client.Database("talkmore").Collection("leases").DeleteOne(mctx, bson.M{"_id": name, "holder": leaseHolder})
+	if err != nil {
+		log.Printf("Failed to release %s lease: %v", name, err)
+	}
+}
+
+func PurgeDeletedAccounts(app *config.AppConfig) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	filter := bson.M{"deletion_scheduled_for": bson.M{"$lte": time.Now()}}
+	cursor, err := app.Client.Database("talkmore").Collection("users").Find(mctx, filter)
+	if err != nil {
+		log.Printf("Failed to find accounts to purge: %v", err)
+		return
+	}
+	var users []models.SetSignUpModel
+	if err := cursor.All(mctx, &users); err != nil {
+		log.Printf("Failed to find accounts to purge: %v", err)
+		return
+	}
+	for _, user := range users {
+		if err := purgeAccount(mctx, app, user); err != nil {
+			log.Printf("Failed to purge account %s: %v", user.User_ID, err)
+			continue
+		}
+		log.Printf("Purged account %s", user.User_ID)
+	}
+}
+
+// purgeAccount removes everything stored for the user and anonymises the
+// copies of their conversations other users keep. The users document goes
+// last so a failed purge is retried on the next run.
+func purgeAccount(mctx context.Context, app *config.AppConfig, user models.SetSignUpModel) error {
+	db := app.Client.Database("talkmore")
+	uid := user.User_ID
+
+	// Photos in storage
+	var posts []struct {
+		PhotoUrl string `bson:"photo_url"`
+	}
+	cursor, err := db.Collection("ulala").Find(mctx, bson.M{"user_id": uid})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(mctx, &posts); err != nil {
+		return err
+	}
+	photoURLs := []string{}
+	if user.Profile_Url != nil {
+		photoURLs = append(photoURLs, *user.Profile_Url)
+	}
+	for _, post := range posts {
+		photoURLs = append(photoURLs, post.PhotoUrl)
+	}
+	for _, url := range photoURLs {
+		if key, ok := s3KeyFromURL(url); ok {
+			if err := deleteFromAWS(mctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	if err := deleteAWSPrefix(mctx, "exports/"+uid+"/"); err != nil {
+		return err
+	}
+
+	// Chats show the user as DeletedUserName from now on. Conversations whose
+	// other participant is gone as well have no one left to read them.
+	if err := purgeOrphanedConversations(mctx, app, uid); err != nil {
+		return err
+	}
+
+	owned := map[string]bson.M{
+		"ulala":          {"user_id": uid},
+		"chats":          {"user_id": uid},
+		"wsmessages":     {"user_id": uid},
+		"userDetails":    {"user_id": uid},
+		"sessions":       {"user_id": uid},
+		"refreshTokens":  {"user_id": uid},
+		"exports":        {"user_id": uid},
+		"passwordResets": {"user_id": uid},
+		"securityEvents": {"user_id": uid},
+		"apiKeys":        {"user_id": uid},
+		"otpSends":       {"recipient": bson.M{"$in": []string{user.Email, user.Phone}}},
+	}
+	for collection, filter := range owned {
+		if _, err := db.Collection(collection).DeleteMany(mctx, filter); err != nil {
+			return err
+		}
+	}
+
+	// A sign-in that restored the account since it was picked keeps it
+	_, err = db.Collection("users").DeleteOne(mctx, bson.M{"user_id": uid, "deletion_scheduled_for": bson.M{"$lte": time.Now()}})
+	app.Principals.InvalidateUser(uid)
+	return err
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"context"
+	"my-work/config"
+	"my-work/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func AdminGetUser(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var user models.AdminUserView
+		err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": ctx.Param("id")}).Decode(&user)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				ErrorResponse(ctx, http.StatusNotFound, "User not found", "no user with this id")
+			} else {
+				ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			}
+			return
+		}
+		user.Role = models.NormalizeRole(user.Role)
+		SuccessResponse(ctx, "User details", user)
+	}
+}
+
+// AdminSetRole changes a user's role. Admins can't change their own role so
+// the last admin can't lock everyone out by accident.
+func AdminSetRole(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.SetRole
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		userID := ctx.Param("id")
+		if userID == ctx.GetString("uid") {
+			ErrorResponse(ctx, http.StatusBadRequest, "Role not changed", "you can't change your own role")
+			return
+		}
+
+		result, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": userID},
+			bson.M{"$set": bson.M{"role": req.Role, "updated_at": time.Now()}},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update role", err.Error())
+			return
+		}
+		if result.MatchedCount == 0 {
+			ErrorResponse(ctx, http.StatusNotFound, "User not found", "no user with this id")
+			return
+		}
+		app.Principals.InvalidateUser(userID)
+		SuccessResponse(ctx, "Role updated", gin.H{"user_id": userID, "role": req.Role})
+	}
+}
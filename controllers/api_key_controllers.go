@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"my-work/oidc"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// apiKeyPrefix starts every key so leaked keys are easy to spot
+	apiKeyPrefix      = "tmk_"
+	maxAPIKeysPerUser = 20
+	// apiKeyTouchInterval limits how often last_used_at is written
+	apiKeyTouchInterval = time.Minute
+)
+
+var errInvalidAPIKey = errors.New("invalid or revoked API key")
+
+// CreateAPIKey issues a new API key for the caller. The key is only ever
+// returned in this response.
+func CreateAPIKey(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.CreateAPIKey
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		for _, scope := range req.Scopes {
+			if permission, ok := models.APIKeyScopePermissions[scope]; ok && !models.HasPermission(ctx.GetString("role"), permission) {
+				ErrorResponse(ctx, http.StatusForbidden, "Scope not allowed", "your role can't grant the "+scope+" scope")
+				return
+			}
+		}
+
+		uid := ctx.GetString("uid")
+		collection := app.Client.Database("talkmore").Collection("apiKeys")
+		count, err := collection.CountDocuments(mctx, bson.M{"user_id": uid, "revoked": false})
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		if count >= maxAPIKeysPerUser {
+			ErrorResponse(ctx, http.StatusBadRequest, "Too many API keys", "revoke an unused key first")
+			return
+		}
+
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to create API key", err.Error())
+			return
+		}
+		secret, err := oidc.RandomString(32)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to create API key", err.Error())
+			return
+		}
+		key := models.APIKey{
+			ID:         hex.EncodeToString(id),
+			User_ID:    uid,
+			Name:       req.Name,
+			Scopes:     req.Scopes,
+			Created_At: time.Now(),
+		}
+		key.Prefix = apiKeyPrefix + key.ID
+		rawKey := key.Prefix + "_" + secret
+		key.Key_Hash = hashAPIKey(rawKey)
+		if req.Expires_In_Days > 0 {
+			expiresAt := key.Created_At.AddDate(0, 0, req.Expires_In_Days)
+			key.Expires_At = &expiresAt
+		}
+
+		if _, err := collection.InsertOne(mctx, key); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to create API key", err.Error())
+			return
+		}
+		SuccessResponse(ctx, "API key created, store it now as it won't be shown again", gin.H{
+			"api_key": rawKey,
+			"key":     key,
+		})
+	}
+}
+
+// ListAPIKeys returns the caller's keys without their secrets
+func ListAPIKeys(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		listAPIKeys(ctx, app, ctx.GetString("uid"))
+	}
+}
+
+// RevokeAPIKey revokes one of the caller's keys
+func RevokeAPIKey(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		revokeAPIKey(ctx, app, ctx.GetString("uid"), ctx.Param("id"))
+	}
+}
+
+// AdminListAPIKeys returns the keys of the :id user
+func AdminListAPIKeys(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		target, ok := loadAPIKeyTarget(ctx, app)
+		if !ok {
+			return
+		}
+		listAPIKeys(ctx, app, target.User_ID)
+	}
+}
+
+// AdminRevokeAPIKey revokes a key of the :id user
+func AdminRevokeAPIKey(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		target, ok := loadAPIKeyTarget(ctx, app)
+		if !ok {
+			return
+		}
+		revokeAPIKey(ctx, app, target.User_ID, ctx.Param("keyid"))
+	}
+}
+
+// loadAPIKeyTarget loads the :id user, who has to rank below the caller
+// like the target of any other moderation action
+func loadAPIKeyTarget(ctx *gin.Context, app *config.AppConfig) (models.SetSignUpModel, bool) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return loadModerationTarget(ctx, mctx, app)
+}
+
+func listAPIKeys(ctx *gin.Context, app *config.AppConfig, uid string) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := app.Client.Database("talkmore").Collection("apiKeys").Find(mctx, bson.M{"user_id": uid}, opts)
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+		return
+	}
+	keys := []models.APIKey{}
+	if err := cursor.All(mctx, &keys); err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+		return
+	}
+	SuccessResponse(ctx, "API keys", keys)
+}
+
+func revokeAPIKey(ctx *gin.Context, app *config.AppConfig, uid, keyID string) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	result, err := app.Client.Database("talkmore").Collection("apiKeys").UpdateOne(mctx,
+		bson.M{"_id": keyID, "user_id": uid, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true, "revoked_at": now}},
+	)
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke API key", err.Error())
+		return
+	}
+	if result.MatchedCount == 0 {
+		ErrorResponse(ctx, http.StatusNotFound, "API key not found", "no active API key with this id")
+		return
+	}
+	SuccessResponse(ctx, "API key revoked", gin.H{"id": keyID})
+}
+
+// revokeAllAPIKeys revokes every active key of uid
+func revokeAllAPIKeys(mctx context.Context, app *config.AppConfig, uid string) error {
+	_, err := app.Client.Database("talkmore").Collection("apiKeys").UpdateMany(mctx,
+		bson.M{"user_id": uid, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true, "revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// LookupAPIKey finds the usable key matching rawKey and records that it was
+// used
+func LookupAPIKey(mctx context.Context, app *config.AppConfig, rawKey string) (models.APIKey, error) {
+	var key models.APIKey
+	id, _, ok := strings.Cut(strings.TrimPrefix(rawKey, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(rawKey, apiKeyPrefix) {
+		return key, errInvalidAPIKey
+	}
+
+	collection := app.Client.Database("talkmore").Collection("apiKeys")
+	err := collection.FindOne(mctx, bson.M{"_id": id}).Decode(&key)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return key, errInvalidAPIKey
+		}
+		return key, err
+	}
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(rawKey)), []byte(key.Key_Hash)) != 1 || !key.Usable(now) {
+		return key, errInvalidAPIKey
+	}
+
+	if key.Last_Used_At == nil || now.Sub(*key.Last_Used_At) > apiKeyTouchInterval {
+		_, err := collection.UpdateOne(mctx, bson.M{"_id": key.ID}, bson.M{"$set": bson.M{"last_used_at": now}})
+		if err != nil {
+			log.Printf("Failed to update last use of API key %s: %v", key.ID, err)
+		}
+	}
+	return key, nil
+}
+
+// hashAPIKey hashes a key for storage. Keys are long and random, so a plain
+// SHA-256 is enough.
+func hashAPIKey(rawKey string) string {
+	sum := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(sum[:])
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math/rand"
 	"my-work/config"
 	"my-work/helper"
 	"my-work/models"
+	"my-work/sms"
 	"my-work/token"
 	"net/http"
 	"time"
@@ -29,8 +29,27 @@ func SignUp(app *config.AppConfig) gin.HandlerFunc {
 			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
 			return
 		}
+		if getSignupDetails.Phone != "" {
+			phone, err := sms.NormalizePhone(getSignupDetails.Phone)
+			if err != nil {
+				ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+				return
+			}
+			getSignupDetails.Phone = phone
+		}
+		if err := app.Validator.Struct(getSignupDetails); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		if !checkPasswordPolicy(ctx, app, getSignupDetails.Password,
+			getSignupDetails.First_Name, getSignupDetails.Last_Name, getSignupDetails.Email, getSignupDetails.Phone) {
+			return
+		}
 
-		if helper.IsFieldUsed(app, mctx, ctx, "email", getSignupDetails.Email) {
+		// Sign-ups are keyed by phone or email, whichever was given
+		field, identifier := signUpIdentifier(getSignupDetails)
+		if helper.IsFieldUsed(app, mctx, ctx, field, identifier) {
 			return
 		}
 		password, err := HashPassword(getSignupDetails.Password)
@@ -38,24 +57,31 @@ func SignUp(app *config.AppConfig) gin.HandlerFunc {
 			ErrorResponse(ctx, http.StatusInternalServerError, "Error In Hashing", err.Error())
 			return
 		}
+		if !AllowOTPSend(ctx, mctx, app, identifier) {
+			return
+		}
+		otp, err := Generate_OTP()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", err.Error())
+			return
+		}
 		getSignupDetails.Password = password
 		getSignupDetails.ID = primitive.NewObjectID()
 		getSignupDetails.User_ID = getSignupDetails.ID.Hex()
-		getSignupDetails.OTP = rand.Intn(9000) + 1000
-		getSignupDetails.Count = 0
+		getSignupDetails.OTP_Hash = HashOTP(app, otp)
+		getSignupDetails.Last_Sent = time.Now()
 
-		message := fmt.Sprintf("Hello, your OTP is %d. Please keep it confidential.", getSignupDetails.OTP)
-		if !SendMail(getSignupDetails.Email, message) {
+		if !sendOTP(app, getSignupDetails.Email, getSignupDetails.Phone, getSignupDetails.First_Name, otp, "5 minutes") {
 			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", "Failed to Send OTP")
 			return
 		}
-		// Create TTL index on tempOtps collection (run once)
-		CreateTTLIndex(app.Client.Database("talkmore").Collection("tempData"))
-		insertTempErr := InsertTempUsers(app.Client.Database("talkmore").Collection("tempData"), getSignupDetails)
+		userID, insertTempErr := InsertTempUsers(app.Client.Database("talkmore").Collection("tempData"), getSignupDetails)
 		if insertTempErr != nil {
 			ErrorResponse(ctx, http.StatusInternalServerError, "Temperory users", "Failed to save temporary user")
 			return
 		}
+		getSignupDetails.User_ID = userID
+		RecordOTPSend(mctx, app, identifier, ctx.ClientIP())
 		SuccessResponse(ctx, "OTP sent and Data stored in Temp", gin.H{"user_id": getSignupDetails.User_ID})
 	}
 }
@@ -71,38 +97,36 @@ func ValidateOtpAndSaveUser(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		filter := bson.M{
-			"user_id": validateOTP.ID,
-			"count":   bson.M{"$lt": 4},
+		attempt, ok := ReserveAttempt(ctx, mctx, app, signUpOTPAttempts, validateOTP.ID)
+		if !ok {
+			return
 		}
 
 		var getSignupDetails models.GetSignUpModel
-		err := app.Client.Database("talkmore").Collection("tempData").FindOne(mctx, filter).Decode(&getSignupDetails)
+		// A used up code keeps its tempData row so ResendOTP can replace it
+		err := takeCodeGuess(mctx, app.Client.Database("talkmore").Collection("tempData"), bson.M{"user_id": validateOTP.ID}, &getSignupDetails)
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
-				ErrorResponse(ctx, http.StatusNotFound, "Not data found", err.Error())
+				attempt.Fail()
+				ErrorResponse(ctx, http.StatusNotFound, "Not data found", "sign-up expired or too many wrong codes, request a new code")
 
 			} else {
+				attempt.Release(mctx)
 				ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
 			}
 			return
 		}
 
-		if getSignupDetails.OTP != validateOTP.OTP {
-			_, updateErr := app.Client.Database("talkmore").Collection("tempData").UpdateOne(
-				mctx,
-				bson.M{"user_id": validateOTP.ID},
-				bson.M{"$inc": bson.M{"count": 1}},
-			)
-			if updateErr != nil {
-				ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update attempt count", updateErr.Error())
-				return
-			}
+		if !CheckOTPHash(app, validateOTP.OTP, getSignupDetails.OTP_Hash) {
+			attempt.Fail()
 			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid OTP", "OTP Not matched")
 			return
 		}
 
-		if helper.IsFieldUsed(app, mctx, ctx, "email", getSignupDetails.Email) {
+		attempt.Succeed(mctx)
+
+		field, identifier := signUpIdentifier(getSignupDetails)
+		if helper.IsFieldUsed(app, mctx, ctx, field, identifier) {
 			return
 		}
 
@@ -110,27 +134,30 @@ func ValidateOtpAndSaveUser(app *config.AppConfig) gin.HandlerFunc {
 		setSignUpModel.ID = getSignupDetails.ID
 		setSignUpModel.User_ID = getSignupDetails.User_ID
 		setSignUpModel.Email = getSignupDetails.Email
+		setSignUpModel.Phone = getSignupDetails.Phone
 		setSignUpModel.First_Name = getSignupDetails.First_Name
 		setSignUpModel.Last_Name = getSignupDetails.Last_Name
 		setSignUpModel.Password = getSignupDetails.Password
+		setSignUpModel.Role = models.RoleUser
 		setSignUpModel.Created_At = time.Now()
 		setSignUpModel.Updated_At = time.Now()
-		setSignUpModel.Revoked = false
 
-		// Generate initial tokens
-		tokenPair, err := token.GenerateTokenPair(setSignUpModel.Email, setSignUpModel.User_ID, app)
+		_, err = app.Client.Database("talkmore").Collection("users").InsertOne(mctx, setSignUpModel)
+		if mongo.IsDuplicateKeyError(err) {
+			// Taken since the check above; the unique index has the last word
+			ErrorResponse(ctx, http.StatusConflict, "Already registered", field+" is already used")
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to generate tokens: %v", err)
-			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to save user", err.Error())
 			return
 		}
 
-		setSignUpModel.Access_Token = tokenPair.AccessToken
-		setSignUpModel.Refresh_Token = tokenPair.RefreshToken
-
-		_, err = app.Client.Database("talkmore").Collection("users").InsertOne(mctx, setSignUpModel)
+		// Generate initial tokens
+		tokenPair, err := StartUserSession(ctx, mctx, app, setSignUpModel)
 		if err != nil {
-			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to save user", err.Error())
+			log.Printf("Failed to generate tokens: %v", err)
+			startSessionFailed(ctx, err)
 			return
 		}
 
@@ -146,49 +173,68 @@ func SignIn(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var creds struct {
 			Email    string `json:"email"`
+			Phone    string `json:"phone"`
 			Password string `json:"password"`
 		}
 		if err := ctx.BindJSON(&creds); err != nil {
 			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
 			return
 		}
+		field, identifier, err := loginIdentifier(creds.Email, creds.Phone)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
 
 		var user models.SetSignUpModel
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"email": creds.Email}).Decode(&user)
+		attempt, ok := ReserveAttempt(ctx, mctx, app, signInAttempts, identifier)
+		if !ok {
+			return
+		}
+
+		err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{field: identifier}).Decode(&user)
 		if err != nil {
-			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", err.Error())
+			if err != mongo.ErrNoDocuments {
+				attempt.Release(mctx)
+				ErrorResponse(ctx, http.StatusInternalServerError, "Something else", "failed to look up account")
+				return
+			}
+			checkDummyPassword(creds.Password)
+			failSignIn(ctx, mctx, app, attempt, "")
 			return
 		}
 
 		if !CheckPasswordHash(creds.Password, user.Password) {
-			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "Password Not Matched")
+			failSignIn(ctx, mctx, app, attempt, user.User_ID)
 			return
 		}
 
-		tokenPair, err := token.GenerateTokenPair(user.Email, user.User_ID, app)
-		if err != nil {
-			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+		// Past the grace period the account is only waiting to be purged
+		if isPastDeletion(user) {
+			attempt.Release(mctx)
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "invalid login or password")
+			return
+		}
+		attempt.Succeed(mctx)
+
+		if rejectRestrictedUser(ctx, user) {
 			return
 		}
 
-		// Update tokens in the database
-		_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(
-			mctx,
-			bson.M{"user_id": user.User_ID},
-			bson.M{"$set": bson.M{
-				"access_token":  tokenPair.AccessToken,
-				"refresh_token": tokenPair.RefreshToken,
-				"updated_at":    time.Now(),
-				"revoked":       false,
-			}},
-		)
+		if user.TOTP_Enabled {
+			TwoFactorChallengeResponse(ctx, mctx, app, user)
+			return
+		}
+
+		tokenPair, err := StartUserSession(ctx, mctx, app, user)
 		if err != nil {
-			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to update tokens", err.Error())
+			startSessionFailed(ctx, err)
 			return
 		}
+
 		SuccessResponse(ctx, "Signed In Successfully", gin.H{
 			"access_token":  tokenPair.AccessToken,
 			"refresh_token": tokenPair.RefreshToken,
@@ -199,21 +245,11 @@ func SignIn(app *config.AppConfig) gin.HandlerFunc {
 
 func MyProfile(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		clientToken, tokenError := GetMyToken(ctx)
-		if tokenError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			ctx.Abort()
-			return
-		}
-		userDetails, idError := GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
-			ctx.Abort()
+		userDetails := CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
-		SuccessResponse(ctx, "My profile", userDetails)
+		SuccessResponse(ctx, "My profile", userDetails.UserDetails)
 	}
 }
 
@@ -227,7 +263,7 @@ func RefreshToken(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		newTokenPair, err := token.RefreshTokens(req.RefreshToken, app)
+		newTokenPair, err := token.RefreshTokens(req.RefreshToken, SessionMetaFromRequest(ctx), app)
 		if err != nil {
 			ErrorResponse(ctx, http.StatusUnauthorized, "Token Error", err.Error())
 			return
@@ -239,19 +275,13 @@ func RefreshToken(app *config.AppConfig) gin.HandlerFunc {
 	}
 }
 
+// Logout revokes the session the request was made with
 func Logout(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		if !app.RequireDBCheck {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "logout not supported in stateless mode"})
-			return
-		}
-
 		uid := ctx.GetString("uid")
 		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx, bson.M{"user_id": uid}, bson.M{
-			"$set": bson.M{"revoked": true, "updated_at": time.Now().Unix()},
-		})
+		_, err := token.RevokeSession(mctx, app, uid, ctx.GetString("sid"))
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
 			return
@@ -260,21 +290,77 @@ func Logout(app *config.AppConfig) gin.HandlerFunc {
 	}
 }
 
-func CreateTTLIndex(collection *mongo.Collection) {
-	index := mongo.IndexModel{
-		Keys:    bson.D{{Key: "expires_at", Value: 1}}, // Accending index on expireAt
-		Options: options.Index().SetExpireAfterSeconds(0),
+// ttlCollections hold short-lived documents that expire at expires_at
+var ttlCollections = []string{
+	"tempData",
+	"otpSends",
+	"passwordResets",
+	"emailChanges",
+	"loginAttempts",
+	"accountUnlocks",
+	"magicLinks",
+	"oidcStates",
+	"twoFactorChallenges",
+	"exports",
+}
+
+// EnsureTTLIndexes creates the expires_at TTL index on every collection of
+// short-lived documents so request handlers don't have to
+func EnsureTTLIndexes(app *config.AppConfig) error {
+	mctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	db := app.Client.Database("talkmore")
+	for _, name := range ttlCollections {
+		_, err := db.Collection(name).Indexes().CreateOne(mctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			return fmt.Errorf("%s TTL index: %w", name, err)
+		}
 	}
-	_, err := collection.Indexes().CreateOne(context.Background(), index)
-	if err != nil {
-		log.Fatal("Failed to create TTL index:", err)
+	return nil
+}
+
+// EnsureUserIndexes makes email and phone unique among users. Phone users
+// have an empty email and email users no phone, so only set values count.
+func EnsureUserIndexes(app *config.AppConfig) error {
+	mctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	users := app.Client.Database("talkmore").Collection("users")
+	for _, field := range []string{"email", "phone"} {
+		_, err := users.Indexes().CreateOne(mctx, mongo.IndexModel{
+			Keys: bson.D{{Key: field, Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{field: bson.M{"$gt": ""}}),
+		})
+		if err != nil {
+			return fmt.Errorf("users %s index: %w", field, err)
+		}
 	}
-	log.Println("TTL index created on expireAt field")
+	return nil
 }
 
-func InsertTempUsers(collection *mongo.Collection, userDetails models.GetSignUpModel) error {
-	userDetails.Expires_At = time.Now().Add(5 * time.Minute)
+// InsertTempUsers stores a pending sign-up. Signing up again with the same
+// email or phone replaces the pending row (keeping its user_id) instead of
+// adding a duplicate. It returns the user_id the OTP must be validated
+// against.
+func InsertTempUsers(collection *mongo.Collection, userDetails models.GetSignUpModel) (string, error) {
+	userDetails.Expires_At = time.Now().Add(otpTTL)
+
+	field, identifier := signUpIdentifier(userDetails)
+	var existing models.GetSignUpModel
+	err := collection.FindOne(context.Background(), bson.M{field: identifier}).Decode(&existing)
+	if err == nil {
+		userDetails.ID = existing.ID
+		userDetails.User_ID = existing.User_ID
+	} else if err != mongo.ErrNoDocuments {
+		return "", err
+	}
 
-	_, err := collection.InsertOne(context.Background(), userDetails)
-	return err
+	opts := options.Replace().SetUpsert(true)
+	_, err = collection.ReplaceOne(context.Background(), bson.M{"_id": userDetails.ID}, userDetails, opts)
+	return userDetails.User_ID, err
 }
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"my-work/config"
@@ -25,20 +26,23 @@ type FaceRequest struct {
 	Target string `json:"target"`
 }
 
+const (
+	defaultChatPageSize = 20
+	maxChatPageSize     = 100
+)
+
+var (
+	errEmptyMessage      = errors.New("message is empty")
+	errInvalidRecipient  = errors.New("invalid recipient")
+	errRecipientNotFound = errors.New("recipient not found")
+)
+
 func SendText(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		clientToken, tokenError := GetMyToken(ctx)
-		if tokenError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			ctx.Abort()
-			return
-		}
-		userDetails, idError := GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
-			ctx.Abort()
+		userDetails := CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
 
@@ -48,39 +52,7 @@ func SendText(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		// same messages in senders
-		// Set the date for the messageDetails
-
-		messageDetails.Date = time.Now().UTC()
-		messageDetails.MessageId = primitive.NewObjectID().Hex()
-		err := SaveMessageByUserId(mctx, messageDetails.Destination, app, *userDetails, messageDetails)
-		if err != nil {
-			ctx.JSON(http.StatusOK, bson.M{"error": err.Error()})
-			return
-		}
-
-		SaveMessageForWebSocket(mctx, app, *userDetails, messageDetails)
-
-		// same messages in receiver
-		nameFields := strings.Split(messageDetails.Name, " ")
-		var receiverDetails models.UserDetails
-
-		receiverDetails.Email = messageDetails.Email
-		receiverDetails.FirstName = nameFields[0]
-		receiverDetails.LastName = nameFields[1]
-		receiverDetails.Profile = messageDetails.Profile
-		receiverDetails.UserID = messageDetails.Destination
-
-		messageDetails.Name = userDetails.FirstName + " " + userDetails.LastName
-		messageDetails.Email = userDetails.Email
-		messageDetails.Profile = userDetails.Profile
-
-		err = SaveMessageByUserId(mctx, receiverDetails.UserID, app, *&receiverDetails, messageDetails)
-		if err != nil {
-			ctx.JSON(http.StatusOK, bson.M{"error": err.Error()})
-			return
-		}
-		err = SaveMessageForWebSocket(mctx, app, *&receiverDetails, messageDetails)
+		_, err := SaveChatMessage(mctx, app, userDetails.UserDetails, messageDetails.Destination, messageDetails.Message)
 		if err != nil {
 			ctx.JSON(http.StatusOK, bson.M{"error": err.Error()})
 			return
@@ -91,73 +63,79 @@ func SendText(app *config.AppConfig) gin.HandlerFunc {
 	}
 }
 
-func SaveMessageByUserId(mctx context.Context, subId string, app *config.AppConfig, userDetails models.UserDetails, messageDetails models.Message) error {
-	// Step 1: Try to update existing sub_id
-	filter := bson.M{
-		"user_id":      userDetails.UserID,
-		"chats.sub_id": subId,
+// SaveChatMessage stores a message from sender to recipientID, moves the
+// conversation to the top of both chat lists and pushes it to both users'
+// WebSocket feeds
+func SaveChatMessage(mctx context.Context, app *config.AppConfig, sender models.UserDetails, recipientID, text string) (models.ChatMessage, error) {
+	var message models.ChatMessage
+	if strings.TrimSpace(text) == "" {
+		return message, errEmptyMessage
 	}
-	update := bson.M{
-		"$push": bson.M{
-			"chats.$.messages": messageDetails,
-		},
-		"$set": bson.M{
-			"chats.$.date":         messageDetails.Date,
-			"chats.$.name":         messageDetails.Name,
-			"chats.$.profile":      messageDetails.Profile,
-			"chats.$.is_unread":    false,
-			"chats.$.last_message": messageDetails.Message,
-		},
+	if recipientID == "" || recipientID == sender.UserID {
+		return message, errInvalidRecipient
 	}
-
-	result, err := app.Client.Database("talkmore").Collection("chats").UpdateOne(mctx, filter, update)
+	recipient, err := LoadPrincipal(mctx, app, &models.SigningDetails{UID: recipientID})
 	if err != nil {
-		log.Printf("Error updating chat for user %s, sub_id %s: %v", userDetails.UserID, messageDetails.Destination, err)
-		return fmt.Errorf("failed to update chat: %w", err)
+		if err == mongo.ErrNoDocuments {
+			return message, errRecipientNotFound
+		}
+		return message, fmt.Errorf("failed to load recipient: %w", err)
 	}
 
-	if result.MatchedCount > 0 {
-		log.Printf("Added message to sub_id %s for user %s, updated date to %s", messageDetails.Destination, userDetails.UserID, messageDetails.Date.String())
-		return nil
+	message = models.ChatMessage{
+		ID:              primitive.NewObjectID().Hex(),
+		Conversation_ID: models.ConversationID(sender.UserID, recipientID),
+		Sender_ID:       sender.UserID,
+		Recipient_ID:    recipientID,
+		Message:         text,
+		Date:            time.Now().UTC(),
+	}
+	db := app.Client.Database("talkmore")
+	if _, err := db.Collection("messages").InsertOne(mctx, message); err != nil {
+		log.Printf("Error saving message from %s to %s: %v", sender.UserID, recipientID, err)
+		return message, fmt.Errorf("failed to save message: %w", err)
 	}
 
-	// Step 2: If no match, add new sub_id or create new document
-	filter = bson.M{"user_id": userDetails.UserID}
-	updateNewSub := bson.M{
-		"$push": bson.M{
-			"chats": bson.M{
-				"sub_id":       messageDetails.Destination,
-				"date":         messageDetails.Date,
-				"name":         messageDetails.Name,
-				"profile":      messageDetails.Profile,
-				"is_unread":    false,
-				"messages":     []interface{}{messageDetails},
-				"last_message": messageDetails.Message,
+	_, err = db.Collection("conversations").UpdateOne(mctx,
+		bson.M{"_id": message.Conversation_ID},
+		bson.M{
+			"$set": bson.M{
+				"last_message":    message.Message,
+				"last_message_id": message.ID,
+				"last_sender_id":  message.Sender_ID,
+				"last_message_at": message.Date,
+				// Senders have read everything up to their own message
+				"read_cursors." + sender.UserID: models.ReadCursor{
+					Message_ID:   message.ID,
+					Message_Date: message.Date,
+					Read_At:      message.Date,
+				},
+			},
+			"$unset": bson.M{"last_hidden_for": ""},
+			"$setOnInsert": bson.M{
+				"participants": []string{sender.UserID, recipientID},
+				"created_at":   message.Date,
 			},
 		},
-	}
-
-	opts := options.Update().SetUpsert(true)
-	result, err = app.Client.Database("talkmore").Collection("chats").UpdateOne(mctx, filter, updateNewSub, opts)
+		options.Update().SetUpsert(true),
+	)
 	if err != nil {
-		log.Printf("Error adding new sub_id or creating document for user %s: %v", userDetails.UserID, err)
-		return fmt.Errorf("failed to add new sub_id or create document: %w", err)
+		log.Printf("Error updating conversation %s: %v", message.Conversation_ID, err)
+		return message, fmt.Errorf("failed to update conversation: %w", err)
 	}
 
-	if result.UpsertedCount > 0 {
-		log.Printf("Created new document with main ID %s and sub_id %s", userDetails.UserID, messageDetails.Destination)
-	} else {
-		log.Printf("Added new sub_id %s to existing main ID %s with date %s", messageDetails.Destination, userDetails.UserID, messageDetails.Date.String())
+	// Each side's feed shows the other user's details
+	if err := SaveMessageForWebSocket(mctx, app, sender, legacyMessage(message, recipient.UserDetails)); err != nil {
+		return message, err
 	}
-	return nil
-}
-func SaveMessageForWebSocket(mctx context.Context, app *config.AppConfig, userDetails models.UserDetails, messageDetails models.Message) error {
-	filter := bson.M{
-		"user_id": userDetails.UserID,
+	if err := SaveMessageForWebSocket(mctx, app, recipient.UserDetails, legacyMessage(message, sender)); err != nil {
+		return message, err
 	}
+	return message, nil
+}
 
-	newDoc := bson.M{
-		"user_id":     userDetails.UserID,
+func SaveMessageForWebSocket(mctx context.Context, app *config.AppConfig, userDetails models.UserDetails, messageDetails models.Message) error {
+	return PushWebSocketEvent(mctx, app, userDetails.UserID, models.WebSocketEventMessage, bson.M{
 		"destination": messageDetails.Destination,
 		"message_id":  messageDetails.MessageId,
 		"message":     messageDetails.Message,
@@ -165,22 +143,23 @@ func SaveMessageForWebSocket(mctx context.Context, app *config.AppConfig, userDe
 		"name":        messageDetails.Name,
 		"profile":     messageDetails.Profile,
 		"email":       messageDetails.Email,
-	}
-
-	opts := options.Replace().SetUpsert(true)
+	})
+}
 
-	result, err := app.Client.Database("talkmore").Collection("wsmessages").ReplaceOne(mctx, filter, newDoc, opts)
-	if err != nil {
-		log.Printf("Error replacing message for user %s: %v", userDetails.UserID, err)
-		return fmt.Errorf("failed to replace message: %w", err)
+// PushWebSocketEvent sends an event to the user's open message sockets
+func PushWebSocketEvent(mctx context.Context, app *config.AppConfig, userID, eventType string, fields bson.M) error {
+	event := bson.M{
+		"user_id": userID,
+		"type":    eventType,
 	}
-
-	if result.UpsertedCount > 0 {
-		log.Printf("Created new document for user %s", userDetails.UserID)
-	} else {
-		log.Printf("Replaced message document for user %s", userDetails.UserID)
+	for key, value := range fields {
+		event[key] = value
 	}
 
+	if err := app.Hub.Publish(userID, event); err != nil {
+		log.Printf("Error publishing %s event for user %s: %v", eventType, userID, err)
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
 	return nil
 }
 
@@ -196,49 +175,66 @@ func GetChats(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		clientToken, tokenError := GetMyToken(ctx)
-		if tokenError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			ctx.Abort()
+		userDetails := CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
-		userDetails, idError := GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
-			ctx.Abort()
+
+		// Newest conversation first
+		opts := chatPage(chatListRequest.Skip, chatListRequest.Limit).
+			SetSort(bson.D{{Key: "last_message_at", Value: -1}})
+		cursor, err := app.Client.Database("talkmore").Collection("conversations").
+			Find(mctx, bson.M{"participants": userDetails.UserID}, opts)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
 			return
 		}
-
-		filter := bson.M{"user_id": userDetails.UserID}
-
-		//MongoDB projection to slice the notification_details array
-		projection := bson.M{
-			"chats": bson.M{
-				"$slice": []int{chatListRequest.Skip, chatListRequest.Limit},
-			},
+		var conversations []models.Conversation
+		if err := cursor.All(mctx, &conversations); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		if len(conversations) == 0 {
+			SuccessResponse(ctx, "No chats", nil)
+			return
 		}
 
-		// Define sorting options (e.g., sort by last_message_date in descending order)
-		sortOption := bson.M{
-			"chats.date": 1, // -1 for descending (newest first), 1 for ascending
+		peerIDs := make([]string, 0, len(conversations))
+		for _, conversation := range conversations {
+			peerIDs = append(peerIDs, conversationPeer(conversation, userDetails.UserID))
 		}
-		// Struct to hold the result
-		var result struct {
-			ChatList []models.ChatUsers `json:"chats" bson:"chats"`
+		peers, err := chatPeers(mctx, app, peerIDs)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
 		}
-		// Execute Query
-		err := app.Client.Database("talkmore").Collection("chats").FindOne(mctx, filter, options.FindOne().SetProjection(projection).SetSort(sortOption)).Decode(&result)
 
-		// handle error
+		unread, err := unreadCounts(mctx, app, conversations, userDetails.UserID)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				SuccessResponse(ctx, "No chats", nil)
-			} else {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+
+		chatList := make([]models.ChatUsers, 0, len(conversations))
+		for i, conversation := range conversations {
+			lastMessage, err := lastVisibleMessage(mctx, app, conversation, userDetails.UserID)
+			if err != nil {
 				ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+				return
 			}
-			return
+			peer := peers[peerIDs[i]]
+			chatList = append(chatList, models.ChatUsers{
+				SubId:          peer.UserID,
+				ConversationID: conversation.ID,
+				Date:           conversation.Last_Message_At,
+				Name:           strings.TrimSpace(peer.FirstName + " " + peer.LastName),
+				Profile:        peer.Profile,
+				IsUnread:       unread[conversation.ID] > 0,
+				UnreadCount:    unread[conversation.ID],
+				LastMessage:    lastMessage,
+			})
 		}
-		SuccessResponse(ctx, "Your chat list", result.ChatList)
+		SuccessResponse(ctx, "Your chat list", chatList)
 	}
 }
 
@@ -254,65 +250,186 @@ func GetMessages(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		clientToken, tokenError := GetMyToken(ctx)
-		if tokenError != "" {
-			ErrorResponse(ctx, http.StatusUnauthorized, "token error", tokenError)
-			ctx.Abort()
+		userDetails := CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
-		userDetails, idError := GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			ErrorResponse(ctx, http.StatusInternalServerError, "User Details Error", idError)
-			ctx.Abort()
+
+		// Newest message first
+		opts := chatPage(messageSkipLimit.Skip, messageSkipLimit.Limit).
+			SetSort(bson.D{{Key: "date", Value: -1}})
+		filter := bson.M{
+			"conversation_id": models.ConversationID(userDetails.UserID, messageSkipLimit.SubID),
+			"hidden_for":      bson.M{"$ne": userDetails.UserID},
+		}
+		cursor, err := app.Client.Database("talkmore").Collection("messages").Find(mctx, filter, opts)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		var messages []models.ChatMessage
+		if err := cursor.All(mctx, &messages); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Cursor error", err.Error())
 			return
 		}
 
-		pipeline := mongo.Pipeline{
-			bson.D{{Key: "$match", Value: bson.M{
-				"user_id": userDetails.UserID,
-			}}},
-			bson.D{{Key: "$unwind", Value: "$chats"}},
-			bson.D{{Key: "$match", Value: bson.M{
-				"chats.sub_id": messageSkipLimit.SubID,
-			}}},
-			bson.D{{Key: "$project", Value: bson.M{
-				"_id": 0,
-				"messages": bson.M{
-					"$slice": []interface{}{
-						bson.M{
-							"$reverseArray": bson.M{
-								"$sortArray": bson.M{
-									"input":  "$chats.messages",
-									"sortBy": bson.M{"date": 1},
-								},
-							},
-						},
-						messageSkipLimit.Skip, messageSkipLimit.Limit,
-					},
-				},
-			}}},
+		if len(messages) == 0 {
+			SuccessResponse(ctx, "No messages found", nil)
+			return
 		}
 
-		cursor, err := app.Client.Database("talkmore").Collection("chats").Aggregate(mctx, pipeline)
+		peers, err := chatPeers(mctx, app, []string{messageSkipLimit.SubID})
 		if err != nil {
-			ErrorResponse(ctx, http.StatusInternalServerError, "Aggregation error", err.Error())
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
 			return
 		}
+		peer := peers[messageSkipLimit.SubID]
+		results := make([]models.Message, 0, len(messages))
+		for _, message := range messages {
+			results = append(results, legacyMessage(message, peer))
+		}
+		SuccessResponse(ctx, "Messages found", results)
+	}
+}
+
+// EnsureChatIndexes creates the indexes chat list and message history
+// queries rely on
+func EnsureChatIndexes(app *config.AppConfig) error {
+	mctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-		var results []struct {
-			Messages []models.Message `bson:"messages"`
+	db := app.Client.Database("talkmore")
+	_, err := db.Collection("conversations").Indexes().CreateOne(mctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "participants", Value: 1}, {Key: "last_message_at", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("conversations index: %w", err)
+	}
+	_, err = db.Collection("messages").Indexes().CreateOne(mctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "date", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("messages index: %w", err)
+	}
+	// Unread counts
+	_, err = db.Collection("messages").Indexes().CreateOne(mctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "recipient_id", Value: 1}, {Key: "date", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("messages unread index: %w", err)
+	}
+	return nil
+}
+
+// purgeOrphanedConversations deletes uid's conversations, and their
+// messages, once no other participant still has an account
+func purgeOrphanedConversations(mctx context.Context, app *config.AppConfig, uid string) error {
+	db := app.Client.Database("talkmore")
+	cursor, err := db.Collection("conversations").Find(mctx, bson.M{"participants": uid})
+	if err != nil {
+		return err
+	}
+	var conversations []models.Conversation
+	if err := cursor.All(mctx, &conversations); err != nil {
+		return err
+	}
+
+	for _, conversation := range conversations {
+		peer := conversationPeer(conversation, uid)
+		if peer != uid {
+			count, err := db.Collection("users").CountDocuments(mctx, bson.M{"user_id": peer})
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
 		}
-		if err := cursor.All(mctx, &results); err != nil {
-			ErrorResponse(ctx, http.StatusInternalServerError, "Cursor error", err.Error())
-			return
+		if _, err := db.Collection("messages").DeleteMany(mctx, bson.M{"conversation_id": conversation.ID}); err != nil {
+			return err
+		}
+		if _, err := db.Collection("conversations").DeleteOne(mctx, bson.M{"_id": conversation.ID}); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if len(results) == 0 {
-			SuccessResponse(ctx, "No messages found", nil)
-			return
+// chatPage turns skip/limit request fields into find options, capping the
+// page size
+func chatPage(skip, limit int) *options.FindOptions {
+	if skip < 0 {
+		skip = 0
+	}
+	if limit <= 0 {
+		limit = defaultChatPageSize
+	}
+	if limit > maxChatPageSize {
+		limit = maxChatPageSize
+	}
+	return options.Find().SetSkip(int64(skip)).SetLimit(int64(limit))
+}
+
+// conversationPeer returns the participant who isn't uid
+func conversationPeer(conversation models.Conversation, uid string) string {
+	for _, participant := range conversation.Participants {
+		if participant != uid {
+			return participant
 		}
+	}
+	return uid
+}
+
+// chatPeers loads the public details of the given users. Users that no
+// longer exist come back as DeletedUserName.
+func chatPeers(mctx context.Context, app *config.AppConfig, uids []string) (map[string]models.UserDetails, error) {
+	opts := options.Find().SetProjection(bson.M{
+		"user_id":     1,
+		"first_name":  1,
+		"last_name":   1,
+		"email":       1,
+		"profile_url": 1,
+	})
+	cursor, err := app.Client.Database("talkmore").Collection("users").Find(mctx, bson.M{"user_id": bson.M{"$in": uids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.SetSignUpModel
+	if err := cursor.All(mctx, &users); err != nil {
+		return nil, err
+	}
+
+	peers := make(map[string]models.UserDetails, len(uids))
+	for _, uid := range uids {
+		peers[uid] = models.UserDetails{UserID: uid, FirstName: DeletedUserName}
+	}
+	for _, user := range users {
+		peer := models.UserDetails{
+			UserID:    user.User_ID,
+			FirstName: user.First_Name,
+			LastName:  user.Last_Name,
+			Email:     user.Email,
+		}
+		if user.Profile_Url != nil {
+			peer.Profile = *user.Profile_Url
+		}
+		peers[user.User_ID] = peer
+	}
+	return peers, nil
+}
 
-		// Assuming there's only one matched chat
-		SuccessResponse(ctx, "Messages found", results[0].Messages)
+// legacyMessage renders a stored message in the shape clients expect, where
+// name, profile and email describe the other side of the conversation
+func legacyMessage(message models.ChatMessage, peer models.UserDetails) models.Message {
+	return models.Message{
+		MessageId:   message.ID,
+		Destination: message.Recipient_ID,
+		Message:     message.Message,
+		Date:        message.Date,
+		Name:        strings.TrimSpace(peer.FirstName + " " + peer.LastName),
+		Profile:     peer.Profile,
+		Email:       peer.Email,
+		EditedAt:    message.Edited_At,
+		Deleted:     message.Deleted_At != nil,
 	}
 }
@@ -2,22 +2,30 @@ package controllers
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"mime/multipart"
 	"my-work/config"
+	"my-work/mailer"
 	"my-work/models"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -27,16 +35,32 @@ import (
 )
 
 var uploader *s3manager.Uploader
+var s3Client *s3.S3
 
 func init() {
 	AWSSession()
 
 }
 
-func Generate_OTP() *int {
+// Generate_OTP returns a six digit code from crypto/rand
+func Generate_OTP() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + 100000, nil
+}
 
-	return nil
+// HashOTP keys the OTP with the app secret so only the hash is stored
+func HashOTP(app *config.AppConfig, otp int) string {
+	mac := hmac.New(sha256.New, app.SecretKey)
+	mac.Write([]byte(strconv.Itoa(otp)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
+// CheckOTPHash compares a submitted OTP with a stored hash in constant time
+func CheckOTPHash(app *config.AppConfig, otp int, hash string) bool {
+	return hmac.Equal([]byte(HashOTP(app, otp)), []byte(hash))
 }
 
 func HashPassword(password string) (string, error) {
@@ -53,7 +77,21 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func SendMail(userMail string, message string) bool {
+// SendMail renders the named mailer template and delivers it to userMail
+func SendMail(app *config.AppConfig, userMail string, templateName string, data interface{}) bool {
+	msg, err := mailer.Render(templateName, data)
+	if err != nil {
+		log.Printf("Failed to render %s mail: %v", templateName, err)
+		return false
+	}
+	msg.To = []string{userMail}
+
+	mctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := app.Mailer.Send(mctx, msg); err != nil {
+		log.Printf("Failed to send %s mail to %s: %v", templateName, userMail, err)
+		return false
+	}
 	return true
 }
 
@@ -72,31 +110,52 @@ func GetMyToken(ctx *gin.Context) (string, string) {
 	return fields[1], ""
 }
 
-func GetMyId(mctx context.Context, app *config.AppConfig, clientToken string) (*models.UserDetails, string) {
-	var userDetails models.UserDetails
-	filter := bson.M{
-		"access_token": clientToken,
-	}
-
-	// Define the projection to return specific fields
+// LoadPrincipal loads the user the token's claims belong to
+func LoadPrincipal(mctx context.Context, app *config.AppConfig, claims *models.SigningDetails) (models.Principal, error) {
+	var user models.SetSignUpModel
 	opts := options.FindOne().SetProjection(bson.M{
 		"user_id":     1,
 		"first_name":  1,
 		"last_name":   1,
 		"email":       1,
+		"phone":       1,
 		"profile_url": 1,
-		"_id":         0,
+		"role":        1,
+		"restriction": 1,
 	})
-
-	// Variable to store the result
-
-	// Execute the query
-	err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, filter, opts).Decode(&userDetails)
+	err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": claims.UID}, opts).Decode(&user)
 	if err != nil {
-		return nil, err.Error()
+		return models.Principal{}, err
+	}
+
+	principal := models.Principal{
+		UserDetails: models.UserDetails{
+			UserID:    user.User_ID,
+			FirstName: user.First_Name,
+			LastName:  user.Last_Name,
+			Email:     user.Email,
+			Phone:     user.Phone,
+		},
+		Role:        models.NormalizeRole(user.Role),
+		Session_ID:  claims.SID,
+		Restriction: user.Restriction,
 	}
+	if user.Profile_Url != nil {
+		principal.Profile = *user.Profile_Url
+	}
+	return principal, nil
+}
 
-	return &userDetails, ""
+// CurrentPrincipal returns the caller resolved by middleware.Authentication.
+// Outside the authenticated route groups it writes a 401 and returns nil.
+func CurrentPrincipal(ctx *gin.Context) *models.Principal {
+	value, ok := ctx.Get("principal")
+	if principal, isPrincipal := value.(models.Principal); ok && isPrincipal {
+		return &principal
+	}
+	ErrorResponse(ctx, http.StatusUnauthorized, "Not authenticated", "no authenticated user for this request")
+	ctx.Abort()
+	return nil
 }
 
 func GetUserMoreDetails(mctx context.Context, app *config.AppConfig, UserID string) (*models.UserMoreDetails, error) {
@@ -167,19 +226,8 @@ func GetByteArray() gin.HandlerFunc {
 
 func UploadUlalaImageAndReturnUrl(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		clientToken, tokenError := GetMyToken(ctx)
-		if tokenError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			ctx.Abort()
-			return
-		}
-		userDetails, idError := GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
-			ctx.Abort()
+		userDetails := CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
 
@@ -206,9 +254,11 @@ func UploadUlalaImageAndReturnUrl(app *config.AppConfig) gin.HandlerFunc {
 
 func SaveFileToAWS(fileReader io.Reader, fileHeader *multipart.FileHeader, pathAndName string) (string, error) {
 	// Upload the file to S3 using the fileReader
+	// The object key must match the returned URL so the photo can be found
+	// again for exports and account purges
 	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucketName),          // Ensure bucketName is set
-		Key:    aws.String(fileHeader.Filename), // Use the filename as the S3 object key
+		Bucket: aws.String(bucketName), // Ensure bucketName is set
+		Key:    aws.String(pathAndName),
 		Body:   fileReader,
 	})
 	if err != nil {
@@ -222,9 +272,9 @@ func SaveFileToAWS(fileReader io.Reader, fileHeader *multipart.FileHeader, pathA
 
 func AWSSession() {
 
-	envError := godotenv.Load()
-	if envError != nil {
-		log.Fatalf("Error loading .env file: %v", envError)
+	// The environment may come from the process instead, as in config.Init
+	if envError := godotenv.Load(); envError != nil {
+		log.Printf("Warning: Could not load .env file: %v", envError)
 	}
 
 	AWS_ACCESS_KEY := os.Getenv("AWS_ACCESS_KEY") // Access Key ID from IAM user
@@ -245,4 +295,60 @@ func AWSSession() {
 	}
 
 	uploader = s3manager.NewUploader(aswSession)
+	s3Client = s3.New(aswSession)
+}
+
+// s3KeyFromURL recovers the object key from a URL built by SaveFileToAWS
+func s3KeyFromURL(objectURL string) (string, bool) {
+	prefix := fmt.Sprintf("https://%s.s3.amazonaws.com/", bucketName)
+	if !strings.HasPrefix(objectURL, prefix) || len(objectURL) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(objectURL, prefix), true
+}
+
+// downloadFromAWS reads a whole object from the bucket
+func downloadFromAWS(mctx context.Context, key string) ([]byte, error) {
+	out, err := s3Client.GetObjectWithContext(mctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// deleteFromAWS removes one object from the bucket
+func deleteFromAWS(mctx context.Context, key string) error {
+	_, err := s3Client.DeleteObjectWithContext(mctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// deleteAWSPrefix removes every object whose key starts with prefix
+func deleteAWSPrefix(mctx context.Context, prefix string) error {
+	return s3Client.ListObjectsV2PagesWithContext(mctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if err := deleteFromAWS(mctx, aws.StringValue(object.Key)); err != nil {
+				log.Printf("Failed to delete %s: %v", aws.StringValue(object.Key), err)
+			}
+		}
+		return true
+	})
+}
+
+// presignAWSObject returns a GET URL for a private object that stops working after ttl
+func presignAWSObject(key string, ttl time.Duration) (string, error) {
+	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
 }
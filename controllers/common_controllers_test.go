@@ -0,0 +1,23 @@
+package controllers
+
+import "testing"
+
+func TestS3KeyFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		key  string
+		want bool
+	}{
+		{"https://" + bucketName + ".s3.amazonaws.com/u1_1700000000000.jpg", "u1_1700000000000.jpg", true},
+		{"https://" + bucketName + ".s3.amazonaws.com/exports/u1/e1.zip", "exports/u1/e1.zip", true},
+		{"https://" + bucketName + ".s3.amazonaws.com/", "", false},
+		{"https://other.s3.amazonaws.com/u1.jpg", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		key, ok := s3KeyFromURL(tt.url)
+		if key != tt.key || ok != tt.want {
+			t.Errorf("s3KeyFromURL(%q) = %q, %v; want %q, %v", tt.url, key, ok, tt.key, tt.want)
+		}
+	}
+}
@@ -3,28 +3,23 @@ package controllers
 import (
 	"context"
 	"my-work/config"
+	"my-work/models"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func GetChatMessages(app *config.AppConfig, userID, subID string) ([]bson.M, error) {
-	var chat struct {
-		Chats []bson.M `bson:"chats"`
-	}
-	err := app.Client.Database("chatmore").Collection("chats").
-		FindOne(context.TODO(), bson.M{"user_id": userID, "chats.sub_id": subID}).
-		Decode(&chat)
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: 1}})
+	cursor, err := app.Client.Database("talkmore").Collection("messages").
+		Find(context.TODO(), bson.M{"conversation_id": models.ConversationID(userID, subID)}, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// Extract messages from the correct sub_id chat
-	for _, c := range chat.Chats {
-		if c["sub_id"] == subID {
-			if messages, ok := c["messages"].([]bson.M); ok {
-				return messages, nil
-			}
-		}
+	var messages []bson.M
+	if err := cursor.All(context.TODO(), &messages); err != nil {
+		return nil, err
 	}
-	return nil, nil
+	return messages, nil
 }
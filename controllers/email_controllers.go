@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/helper"
+	"my-work/mailer"
+	"my-work/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const emailChangeTTL = 15 * time.Minute
+
+// RequestEmailChange sends a verification OTP to the new address. The login
+// email only changes once ConfirmEmailChange receives that OTP.
+func RequestEmailChange(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.ChangeEmail
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		req.New_Email = strings.TrimSpace(req.New_Email)
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if !confirmIdentity(ctx, mctx, app, user, req.Password) {
+			return
+		}
+		if strings.EqualFold(req.New_Email, user.Email) {
+			ErrorResponse(ctx, http.StatusBadRequest, "Email not changed", "new email is the same as the current one")
+			return
+		}
+		if helper.IsFieldUsed(app, mctx, ctx, "email", req.New_Email) {
+			return
+		}
+		if !AllowOTPSend(ctx, mctx, app, req.New_Email) {
+			return
+		}
+
+		otp, err := Generate_OTP()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", err.Error())
+			return
+		}
+		change := models.EmailChangeModel{
+			User_ID:    user.User_ID,
+			Old_Email:  user.Email,
+			New_Email:  req.New_Email,
+			OTP_Hash:   HashOTP(app, otp),
+			Expires_At: time.Now().Add(emailChangeTTL),
+		}
+		collection := app.Client.Database("talkmore").Collection("emailChanges")
+		_, err = collection.ReplaceOne(mctx, bson.M{"user_id": user.User_ID}, change, options.Replace().SetUpsert(true))
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Email change", "Failed to save email change")
+			return
+		}
+
+		mailData := gin.H{
+			"Name":      user.First_Name,
+			"OTP":       otp,
+			"ExpiresIn": "15 minutes",
+		}
+		if !SendMail(app, req.New_Email, mailer.TemplateOTP, mailData) {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", "Failed to Send OTP")
+			return
+		}
+		RecordOTPSend(mctx, app, req.New_Email, ctx.ClientIP())
+
+		SuccessResponse(ctx, "Verification code sent to the new address", gin.H{"new_email": req.New_Email})
+	}
+}
+
+// ConfirmEmailChange swaps the login email, including the copies of it kept
+// in Ulala posts, and tells the old address
+func ConfirmEmailChange(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.ConfirmEmailChange
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		uid := ctx.GetString("uid")
+		attempt, ok := ReserveAttempt(ctx, mctx, app, emailOTPAttempts, uid)
+		if !ok {
+			return
+		}
+
+		collection := app.Client.Database("talkmore").Collection("emailChanges")
+		var change models.EmailChangeModel
+		err := takeCodeGuess(mctx, collection, bson.M{"user_id": uid}, &change)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				attempt.Fail()
+				ErrorResponse(ctx, http.StatusNotFound, "Not data found", "email change expired, not requested or too many wrong codes")
+			} else {
+				attempt.Release(mctx)
+				ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			}
+			return
+		}
+
+		if !CheckOTPHash(app, req.OTP, change.OTP_Hash) {
+			dropSpentCode(mctx, collection, bson.M{"user_id": uid}, change.Failures)
+			attempt.Fail()
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid OTP", "OTP Not matched")
+			return
+		}
+		attempt.Succeed(mctx)
+
+		// Someone may have taken the address since the code was sent
+		if helper.IsFieldUsed(app, mctx, ctx, "email", change.New_Email) {
+			return
+		}
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		result, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": uid, "email": change.Old_Email},
+			bson.M{"$set": bson.M{"email": change.New_Email, "updated_at": time.Now()}},
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			// Taken since the check above; the unique index has the last word
+			ErrorResponse(ctx, http.StatusConflict, "Email already used", "email is already used")
+			return
+		}
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to change email", err.Error())
+			return
+		}
+		if result.MatchedCount == 0 {
+			// The email changed some other way after this code was sent
+			if _, err := collection.DeleteOne(mctx, bson.M{"user_id": uid}); err != nil {
+				log.Printf("Failed to delete stale email change for user %s: %v", uid, err)
+			}
+			ErrorResponse(ctx, http.StatusConflict, "Email change outdated", "your email changed since this code was sent, please start again")
+			return
+		}
+		app.Principals.InvalidateUser(uid)
+
+		if err := replaceDenormalisedEmail(mctx, app, uid, change.New_Email); err != nil {
+			log.Printf("Failed to update copies of email for user %s: %v", uid, err)
+		}
+		if _, err := collection.DeleteOne(mctx, bson.M{"user_id": uid}); err != nil {
+			log.Printf("Failed to delete email change for user %s: %v", uid, err)
+		}
+
+		go SendMail(app, change.Old_Email, mailer.TemplateEmailChanged, gin.H{
+			"Name":     user.First_Name,
+			"NewEmail": change.New_Email,
+		})
+
+		SuccessResponse(ctx, "Email changed", gin.H{"email": change.New_Email})
+	}
+}
+
+// replaceDenormalisedEmail updates the copies of a user's email stored
+// outside the users collection
+func replaceDenormalisedEmail(mctx context.Context, app *config.AppConfig, uid, newEmail string) error {
+	db := app.Client.Database("talkmore")
+
+	_, err := db.Collection("ulala").UpdateMany(mctx,
+		bson.M{"user_id": uid},
+		bson.M{"$set": bson.M{"email": newEmail}},
+	)
+	return err
+}
@@ -0,0 +1,315 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"log"
+	"my-work/config"
+	"my-work/mailer"
+	"my-work/models"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	exportLinkTTL   = 24 * time.Hour
+	exportBuildTime = 10 * time.Minute
+)
+
+// userSecretFields are stripped from the profile before it is exported
+var userSecretFields = []string{"password", "totp_secret", "totp_pending_secret", "totp_last_step", "recovery_codes"}
+
+// RequestDataExport starts building a ZIP of everything we hold about the
+// user. The user is emailed a download link when it is ready.
+func RequestDataExport(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		uid := ctx.GetString("uid")
+		collection := app.Client.Database("talkmore").Collection("exports")
+
+		// Only one export at a time per user
+		var pending models.DataExport
+		err := collection.FindOne(mctx, bson.M{"user_id": uid, "status": models.ExportPending}).Decode(&pending)
+		if err == nil {
+			ctx.JSON(http.StatusAccepted, models.APIResponse{Success: true, Message: "Export already in progress", Data: pending})
+			return
+		}
+		if err != mongo.ErrNoDocuments {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+
+		now := time.Now()
+		job := models.DataExport{
+			Export_ID:  primitive.NewObjectID().Hex(),
+			User_ID:    uid,
+			Status:     models.ExportPending,
+			Created_At: now,
+			Expires_At: now.Add(30 * 24 * time.Hour),
+		}
+		if _, err := collection.InsertOne(mctx, job); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to start export", err.Error())
+			return
+		}
+
+		go buildDataExport(app, job)
+
+		ctx.JSON(http.StatusAccepted, models.APIResponse{Success: true, Message: "Export started", Data: job})
+	}
+}
+
+func GetDataExport(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var job models.DataExport
+		filter := bson.M{"export_id": ctx.Param("id"), "user_id": ctx.GetString("uid")}
+		err := app.Client.Database("talkmore").Collection("exports").FindOne(mctx, filter).Decode(&job)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				ErrorResponse(ctx, http.StatusNotFound, "Export not found", "no export with this id")
+			} else {
+				ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			}
+			return
+		}
+		if job.Url_Expires_At != nil && time.Now().After(*job.Url_Expires_At) {
+			job.Download_Url = ""
+		}
+		SuccessResponse(ctx, "Export status", job)
+	}
+}
+
+// PurgeExpiredExports deletes export archives from storage once their
+// download link has expired. The job record stays until its own TTL.
+func PurgeExpiredExports(app *config.AppConfig) {
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	collection := app.Client.Database("talkmore").Collection("exports")
+	filter := bson.M{"object_key": bson.M{"$exists": true}, "url_expires_at": bson.M{"$lte": time.Now()}}
+	cursor, err := collection.Find(mctx, filter)
+	if err != nil {
+		log.Printf("Failed to find expired exports: %v", err)
+		return
+	}
+	var jobs []models.DataExport
+	if err := cursor.All(mctx, &jobs); err != nil {
+		log.Printf("Failed to find expired exports: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		if err := deleteFromAWS(mctx, job.Object_Key); err != nil {
+			log.Printf("Failed to delete archive of export %s: %v", job.Export_ID, err)
+			continue
+		}
+		_, err := collection.UpdateOne(mctx, bson.M{"export_id": job.Export_ID}, bson.M{"$unset": bson.M{"object_key": "", "download_url": ""}})
+		if err != nil {
+			log.Printf("Failed to mark export %s deleted: %v", job.Export_ID, err)
+		}
+	}
+}
+
+// buildDataExport assembles the archive, uploads it and emails the link
+func buildDataExport(app *config.AppConfig, job models.DataExport) {
+	mctx, cancel := context.WithTimeout(context.Background(), exportBuildTime)
+	defer cancel()
+
+	collection := app.Client.Database("talkmore").Collection("exports")
+	fail := func(err error) {
+		log.Printf("Data export %s for user %s failed: %v", job.Export_ID, job.User_ID, err)
+		now := time.Now()
+		_, updateErr := collection.UpdateOne(mctx, bson.M{"export_id": job.Export_ID}, bson.M{"$set": bson.M{
+			"status":       models.ExportFailed,
+			"error":        "export could not be built, please try again later",
+			"completed_at": now,
+		}})
+		if updateErr != nil {
+			log.Printf("Failed to mark export %s failed: %v", job.Export_ID, updateErr)
+		}
+	}
+
+	file, err := os.CreateTemp("", "talkmore-export-*.zip")
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	profile, err := writeExportArchive(mctx, app, job.User_ID, file)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		fail(err)
+		return
+	}
+
+	key := fmt.Sprintf("exports/%s/%s.zip", job.User_ID, job.Export_ID)
+	_, err = uploader.UploadWithContext(mctx, &s3manager.UploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String("application/zip"),
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	link, err := presignAWSObject(key, exportLinkTTL)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	now := time.Now()
+	linkExpiry := now.Add(exportLinkTTL)
+	_, err = collection.UpdateOne(mctx, bson.M{"export_id": job.Export_ID}, bson.M{"$set": bson.M{
+		"status":         models.ExportReady,
+		"object_key":     key,
+		"download_url":   link,
+		"url_expires_at": linkExpiry,
+		"completed_at":   now,
+	}})
+	if err != nil {
+		log.Printf("Failed to mark export %s ready: %v", job.Export_ID, err)
+		return
+	}
+
+	email, _ := profile["email"].(string)
+	name, _ := profile["first_name"].(string)
+	if email != "" {
+		SendMail(app, email, mailer.TemplateDataExport, gin.H{
+			"Name":      name,
+			"Link":      link,
+			"ExpiresAt": linkExpiry.UTC().Format(time.RFC1123),
+		})
+	}
+}
+
+// writeExportArchive writes every collection entry and photo we hold for the
+// user into a ZIP and returns the exported profile
+func writeExportArchive(mctx context.Context, app *config.AppConfig, uid string, file *os.File) (bson.M, error) {
+	db := app.Client.Database("talkmore")
+	archive := zip.NewWriter(file)
+
+	var profile bson.M
+	if err := db.Collection("users").FindOne(mctx, bson.M{"user_id": uid}).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("load profile: %w", err)
+	}
+	for _, field := range userSecretFields {
+		delete(profile, field)
+	}
+	if err := writeExportJSON(archive, "profile.json", profile); err != nil {
+		return nil, err
+	}
+
+	collections := []struct {
+		file       string
+		collection string
+		filter     bson.M
+	}{
+		{"user_more_details.json", "userDetails", bson.M{"user_id": uid}},
+		{"conversations.json", "conversations", bson.M{"participants": uid}},
+		{"messages.json", "messages", bson.M{"$or": []bson.M{{"sender_id": uid}, {"recipient_id": uid}}}},
+		{"ulala_posts.json", "ulala", bson.M{"user_id": uid}},
+		{"sessions.json", "sessions", bson.M{"user_id": uid}},
+		{"security_events.json", "securityEvents", bson.M{"user_id": uid}},
+	}
+	var posts []bson.M
+	for _, c := range collections {
+		cursor, err := db.Collection(c.collection).Find(mctx, c.filter)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", c.collection, err)
+		}
+		docs := []bson.M{}
+		if err := cursor.All(mctx, &docs); err != nil {
+			return nil, fmt.Errorf("load %s: %w", c.collection, err)
+		}
+		if c.collection == "ulala" {
+			posts = docs
+		}
+		if err := writeExportJSON(archive, c.file, docs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Photos: the profile picture and every Ulala upload
+	photoURLs := []string{}
+	if url, ok := profile["profile_url"].(string); ok && url != "" {
+		photoURLs = append(photoURLs, url)
+	}
+	for _, post := range posts {
+		if url, ok := post["photo_url"].(string); ok && url != "" {
+			photoURLs = append(photoURLs, url)
+		}
+	}
+	missing := []string{}
+	for _, url := range photoURLs {
+		key, ok := s3KeyFromURL(url)
+		if !ok {
+			missing = append(missing, url)
+			continue
+		}
+		data, err := downloadFromAWS(mctx, key)
+		if err != nil {
+			log.Printf("Export for user %s: failed to download %s: %v", uid, key, err)
+			missing = append(missing, url)
+			continue
+		}
+		w, err := archive.Create("photos/" + path.Base(key))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) > 0 {
+		if err := writeExportJSON(archive, "photos/missing.json", missing); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// writeExportJSON stores a value as relaxed extended JSON so dates and ids
+// stay readable
+func writeExportJSON(archive *zip.Writer, name string, value interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	switch v := value.(type) {
+	case bson.M:
+		data, err = bson.MarshalExtJSONIndent(v, false, false, "", "  ")
+	default:
+		data, err = bson.MarshalExtJSONIndent(bson.M{"items": v}, false, false, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", name, err)
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -31,17 +31,10 @@ func Ulala(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		clientToken, tokenError := controllers.GetMyToken(ctx)
-		if tokenError != "" {
-			controllers.ErrorResponse(ctx, http.StatusUnauthorized, "token error", tokenError)
-			ctx.Abort()
+		userDetails := controllers.CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
-		userDetails, idError := controllers.GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			controllers.ErrorResponse(ctx, http.StatusUnauthorized, "Id Error", idError)
-			ctx.Abort()
-		}
 		userMoreDetails, detailError := controllers.GetUserMoreDetails(mctx, app, userDetails.UserID)
 		if detailError != nil {
 			controllers.ErrorResponse(ctx, http.StatusInternalServerError, "More Detail Error", detailError.Error())
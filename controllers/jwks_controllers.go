@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"my-work/config"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JWKS publishes the public JWT signing keys so other services can verify
+// talkmore tokens without sharing a secret
+func JWKS(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Header("Cache-Control", "public, max-age=300")
+		ctx.JSON(http.StatusOK, app.Keyring.JWKS())
+	}
+}
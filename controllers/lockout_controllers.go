@@ -0,0 +1,422 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"my-work/config"
+	"my-work/mailer"
+	"my-work/models"
+	"my-work/token"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// attemptPolicy says how failed attempts in one scope are throttled. The
+// first freeFailures failures cost nothing, after that every failure doubles
+// the wait before the next try, and maxFailures locks the caller out.
+//
+// Failures are counted per subject, per subject and IP, and per IP. Only the
+// last two lock out: anyone can fail against a subject, so the subject alone
+// just backs off, which keeps a stranger from locking the owner out.
+type attemptPolicy struct {
+	scope        string
+	freeFailures int
+	maxFailures  int
+	lockout      time.Duration
+}
+
+const (
+	attemptWindow    = 24 * time.Hour
+	attemptBaseDelay = time.Second
+	maxAttemptDelay  = 5 * time.Minute
+	// Many users can sit behind one address, so an IP gets more failures
+	// than a single account before it is locked out
+	ipFailureFactor  = 5
+	accountUnlockTTL = 10 * time.Minute
+)
+
+var (
+	signInAttempts    = attemptPolicy{scope: "signin", freeFailures: 3, maxFailures: 10, lockout: 30 * time.Minute}
+	signUpOTPAttempts = attemptPolicy{scope: "signup_otp", freeFailures: 3, maxFailures: 4, lockout: otpTTL}
+	resetOTPAttempts  = attemptPolicy{scope: "password_reset", freeFailures: 3, maxFailures: 4, lockout: passwordResetTTL}
+	emailOTPAttempts  = attemptPolicy{scope: "email_change", freeFailures: 3, maxFailures: 4, lockout: emailChangeTTL}
+	twoFactorAttempts = attemptPolicy{scope: "2fa", freeFailures: 3, maxFailures: 10, lockout: 30 * time.Minute}
+	unlockAttempts    = attemptPolicy{scope: "unlock", freeFailures: 3, maxFailures: 4, lockout: accountUnlockTTL}
+)
+
+// dummyPasswordHash is compared against when the login is unknown so a
+// failed sign-in takes as long whether or not the account exists
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+func checkDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = HashPassword("talkmore-dummy-password")
+	})
+	CheckPasswordHash(password, dummyPasswordHash)
+}
+
+func attemptKey(policy attemptPolicy, kind, subject string) string {
+	return policy.scope + ":" + kind + ":" + strings.ToLower(strings.TrimSpace(subject))
+}
+
+// attemptPairKey is the key for failures against subject from one IP
+func attemptPairKey(policy attemptPolicy, subject, ip string) string {
+	return attemptKey(policy, "account_ip", subject) + "|" + ip
+}
+
+// attemptCounter is one of the keys an attempt is counted against. A
+// maxFailures of 0 backs off without ever locking out.
+type attemptCounter struct {
+	key         string
+	maxFailures int
+}
+
+func attemptCounters(policy attemptPolicy, subject, ip string) []attemptCounter {
+	return []attemptCounter{
+		{attemptPairKey(policy, subject, ip), policy.maxFailures},
+		{attemptKey(policy, "account", subject), 0},
+		{attemptKey(policy, "ip", ip), policy.maxFailures * ipFailureFactor},
+	}
+}
+
+// reservedAttempt is an attempt counted as a failure before the credential
+// is checked, so a burst of concurrent requests can't all get in under the
+// limit. Succeed takes it back when the credential turns out to be right.
+type reservedAttempt struct {
+	app      *config.AppConfig
+	policy   attemptPolicy
+	subject  string
+	counters []attemptCounter
+	// before holds each counter as it was before this attempt was counted
+	before []models.LoginAttempt
+}
+
+// ReserveAttempt counts an attempt against the subject (an email, phone or
+// user_id), the subject from the client IP and the IP, unless one of them is
+// backing off or locked out. Then it writes a 429 and returns false.
+func ReserveAttempt(ctx *gin.Context, mctx context.Context, app *config.AppConfig, policy attemptPolicy, subject string) (*reservedAttempt, bool) {
+	attempt, retryAfter, err := reserveAttempt(mctx, app, policy, subject, ctx.ClientIP())
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+		return nil, false
+	}
+	if retryAfter > 0 {
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		ErrorResponse(ctx, http.StatusTooManyRequests, "Too many attempts", gin.H{"retry_after_seconds": seconds})
+		return nil, false
+	}
+	return attempt, true
+}
+
+// reserveAttempt counts the attempt on each counter that isn't locked. The
+// count and the wait it earns are written together, so whichever request
+// takes the last try locks out every request after it. A non-zero wait
+// means the attempt was refused and nothing was counted.
+func reserveAttempt(mctx context.Context, app *config.AppConfig, policy attemptPolicy, subject, ip string) (*reservedAttempt, time.Duration, error) {
+	collection := app.Client.Database("talkmore").Collection("loginAttempts")
+	attempt := &reservedAttempt{app: app, policy: policy, subject: subject, counters: attemptCounters(policy, subject, ip)}
+
+	now := time.Now()
+	for _, counter := range attempt.counters {
+		// Counters past their window start again; the TTL monitor only runs
+		// once a minute
+		failures := bson.M{"$cond": bson.A{
+			bson.M{"$lt": bson.A{"$expires_at", now}},
+			1,
+			bson.M{"$add": bson.A{"$failures", 1}},
+		}}
+		update := mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{"failures": failures, "scope": policy.scope, "last_failure": now, "expires_at": now.Add(attemptWindow)}}},
+			{{Key: "$set", Value: bson.M{"locked_until": bson.M{"$max": bson.A{
+				"$locked_until",
+				bson.M{"$add": bson.A{now, attemptDelayExpr(policy, counter.maxFailures)}},
+			}}}}},
+		}
+		var before models.LoginAttempt
+		err := collection.FindOneAndUpdate(
+			mctx,
+			bson.M{"_id": counter.key, "locked_until": bson.M{"$not": bson.M{"$gt": now}}},
+			update,
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+		).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			// Upserted: this is the first attempt in the window
+			err = nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			// The counter exists but is locked, so the upsert collided with it
+			attempt.Release(mctx)
+			return nil, lockedFor(mctx, collection, counter.key, now), nil
+		}
+		if err != nil {
+			attempt.Release(mctx)
+			return nil, 0, err
+		}
+		attempt.before = append(attempt.before, before)
+	}
+	return attempt, 0, nil
+}
+
+// lockedFor returns how much longer the counter stays locked, at least a
+// second since a lock that has just run out still refused the attempt
+func lockedFor(mctx context.Context, collection *mongo.Collection, key string, now time.Time) time.Duration {
+	var locked models.LoginAttempt
+	if err := collection.FindOne(mctx, bson.M{"_id": key}).Decode(&locked); err != nil {
+		log.Printf("Failed to read lock on %s: %v", key, err)
+	}
+	if wait := locked.Locked_Until.Sub(now); wait > time.Second {
+		return wait
+	}
+	return time.Second
+}
+
+// Fail leaves the attempt counted. It reports whether this failure locked
+// the subject out for the IP.
+func (a *reservedAttempt) Fail() bool {
+	pair := a.counters[0]
+	return countedFailures(a.before[0]) == pair.maxFailures
+}
+
+// Succeed forgets the subject's failures, from every IP. The IP counter
+// only loses this attempt so one good password can't reset a guessing run
+// against other accounts.
+func (a *reservedAttempt) Succeed(mctx context.Context) {
+	ClearFailedAttempts(mctx, a.app, a.policy, a.subject)
+
+	ip := len(a.counters) - 1
+	_, err := a.app.Client.Database("talkmore").Collection("loginAttempts").UpdateOne(mctx,
+		bson.M{"_id": a.counters[ip].key},
+		bson.M{"$inc": bson.M{"failures": -1}, "$set": bson.M{"locked_until": a.before[ip].Locked_Until}},
+	)
+	if err != nil {
+		log.Printf("Failed to release %s attempt for %s: %v", a.policy.scope, a.counters[ip].key, err)
+	}
+}
+
+// Release uncounts the attempt when it was never checked, for instance
+// because of a server error. Any wait it earned is left to run out.
+func (a *reservedAttempt) Release(mctx context.Context) {
+	collection := a.app.Client.Database("talkmore").Collection("loginAttempts")
+	for i := range a.before {
+		_, err := collection.UpdateOne(mctx, bson.M{"_id": a.counters[i].key}, bson.M{"$inc": bson.M{"failures": -1}})
+		if err != nil {
+			log.Printf("Failed to release %s attempt for %s: %v", a.policy.scope, a.counters[i].key, err)
+		}
+	}
+}
+
+// countedFailures is the count the reservation left on a counter given the
+// counter before it
+func countedFailures(before models.LoginAttempt) int {
+	if before.Expires_At.Before(time.Now()) {
+		return 1
+	}
+	return before.Failures + 1
+}
+
+// attemptDelay is the wait imposed after the given number of failures. With
+// maxFailures 0 it only backs off.
+func attemptDelay(policy attemptPolicy, failures, maxFailures int) time.Duration {
+	if maxFailures > 0 && failures >= maxFailures {
+		return policy.lockout
+	}
+	if failures <= policy.freeFailures {
+		return 0
+	}
+	delay := attemptBaseDelay << uint(failures-policy.freeFailures-1)
+	if delay > maxAttemptDelay || delay <= 0 {
+		delay = maxAttemptDelay
+	}
+	return delay
+}
+
+// attemptDelayExpr is attemptDelay, in milliseconds, as an aggregation
+// expression on the failures field. Past some count the delay stops
+// changing, so every count before that gets its own branch.
+func attemptDelayExpr(policy attemptPolicy, maxFailures int) interface{} {
+	last := 64
+	if maxFailures > last {
+		last = maxFailures
+	}
+	settled := attemptDelay(policy, last+1, maxFailures).Milliseconds()
+
+	var branches bson.A
+	for failures := 1; failures <= last; failures++ {
+		delay := attemptDelay(policy, failures, maxFailures).Milliseconds()
+		if delay == settled {
+			continue
+		}
+		branches = append(branches, bson.M{"case": bson.M{"$eq": bson.A{"$failures", failures}}, "then": delay})
+	}
+	if len(branches) == 0 {
+		return settled
+	}
+	return bson.M{"$switch": bson.M{"branches": branches, "default": settled}}
+}
+
+// ClearFailedAttempts forgets the subject's failures, from every IP. The IP
+// counters are left alone.
+func ClearFailedAttempts(mctx context.Context, app *config.AppConfig, policy attemptPolicy, subject string) {
+	_, err := app.Client.Database("talkmore").Collection("loginAttempts").DeleteMany(mctx, bson.M{"$or": bson.A{
+		bson.M{"_id": attemptKey(policy, "account", subject)},
+		bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(attemptPairKey(policy, subject, ""))}},
+	}})
+	if err != nil {
+		log.Printf("Failed to clear %s attempts for %s: %v", policy.scope, subject, err)
+	}
+}
+
+// RequestAccountUnlock emails or texts a code that lifts a sign-in lockout.
+// The response is the same whether or not the account exists.
+func RequestAccountUnlock(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.RequestAccountUnlock
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		field, identifier, err := loginIdentifier(req.Email, req.Phone)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		// Throttle and count the request before the lookup so unknown logins
+		// are rate limited exactly like existing accounts
+		if !AllowOTPSend(ctx, mctx, app, identifier) {
+			return
+		}
+		RecordOTPSend(mctx, app, identifier, ctx.ClientIP())
+
+		var user models.SetSignUpModel
+		err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{field: identifier}).Decode(&user)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Printf("Failed to look up user for account unlock: %v", err)
+			}
+			SuccessResponse(ctx, "If the account exists, an unlock code has been sent", nil)
+			return
+		}
+
+		otp, err := Generate_OTP()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", err.Error())
+			return
+		}
+		unlock := models.AccountUnlockModel{
+			User_ID:    user.User_ID,
+			Identifier: identifier,
+			OTP_Hash:   HashOTP(app, otp),
+			Expires_At: time.Now().Add(accountUnlockTTL),
+		}
+
+		collection := app.Client.Database("talkmore").Collection("accountUnlocks")
+		_, err = collection.ReplaceOne(mctx, bson.M{"user_id": user.User_ID}, unlock, options.Replace().SetUpsert(true))
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Account unlock", "Failed to save unlock code")
+			return
+		}
+
+		// Sent in the background so the response takes as long as it does for
+		// an unknown login; SendSMS and SendMail log failures
+		if field == "phone" {
+			go SendSMS(app, identifier, fmt.Sprintf("Your talkmore unlock code is %d. It expires in 10 minutes.", otp))
+		} else {
+			go SendMail(app, identifier, mailer.TemplateAccountUnlock, gin.H{
+				"Name":      user.First_Name,
+				"OTP":       otp,
+				"ExpiresIn": "10 minutes",
+			})
+		}
+		SuccessResponse(ctx, "If the account exists, an unlock code has been sent", nil)
+	}
+}
+
+// UnlockAccount checks the unlock code and clears the account's
+// failed sign-ins. Per-IP backoff is not lifted.
+func UnlockAccount(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.UnlockAccount
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		_, identifier, err := loginIdentifier(req.Email, req.Phone)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		attempt, ok := ReserveAttempt(ctx, mctx, app, unlockAttempts, identifier)
+		if !ok {
+			return
+		}
+
+		collection := app.Client.Database("talkmore").Collection("accountUnlocks")
+		var unlock models.AccountUnlockModel
+		err = takeCodeGuess(mctx, collection, bson.M{"identifier": identifier}, &unlock)
+		if err != nil && err != mongo.ErrNoDocuments {
+			attempt.Release(mctx)
+			ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			return
+		}
+		if err == mongo.ErrNoDocuments || !CheckOTPHash(app, req.OTP, unlock.OTP_Hash) {
+			if err == nil {
+				dropSpentCode(mctx, collection, bson.M{"identifier": identifier}, unlock.Failures)
+			}
+			attempt.Fail()
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid OTP", "Unlock code expired or not matched")
+			return
+		}
+
+		ClearFailedAttempts(mctx, app, signInAttempts, unlock.Identifier)
+		attempt.Succeed(mctx)
+		if _, err := collection.DeleteOne(mctx, bson.M{"user_id": unlock.User_ID}); err != nil {
+			log.Printf("Failed to delete used unlock code for user %s: %v", unlock.User_ID, err)
+		}
+
+		SuccessResponse(ctx, "Account unlocked", nil)
+	}
+}
+
+// failSignIn fails the sign-in attempt and answers with the same error for an
+// unknown email or phone, a wrong password and a deleted account
+func failSignIn(ctx *gin.Context, mctx context.Context, app *config.AppConfig, attempt *reservedAttempt, uid string) {
+	if attempt.Fail() && uid != "" {
+		token.LogSecurityEvent(mctx, app, models.SecurityEvent{
+			User_ID:    uid,
+			Type:       models.SecurityEventAccountLocked,
+			IP:         ctx.ClientIP(),
+			User_Agent: ctx.Request.UserAgent(),
+			Details:    fmt.Sprintf("sign-in from %s locked for %s after %d failed attempts", ctx.ClientIP(), signInAttempts.lockout, signInAttempts.maxFailures),
+		})
+	}
+	ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "invalid login or password")
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"my-work/models"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAttemptDelay(t *testing.T) {
+	policy := attemptPolicy{scope: "test", freeFailures: 3, maxFailures: 10, lockout: 30 * time.Minute}
+	tests := []struct {
+		failures    int
+		maxFailures int
+		want        time.Duration
+	}{
+		{1, 10, 0},
+		{3, 10, 0},
+		{4, 10, time.Second},
+		{5, 10, 2 * time.Second},
+		{9, 10, 32 * time.Second},
+		{10, 10, 30 * time.Minute},
+		{50, 50, 30 * time.Minute},
+		// Backoff only: the wait is capped and never becomes a lockout
+		{10, 0, 64 * time.Second},
+		{20, 0, maxAttemptDelay},
+		{1000, 0, maxAttemptDelay},
+	}
+	for _, tt := range tests {
+		if got := attemptDelay(policy, tt.failures, tt.maxFailures); got != tt.want {
+			t.Errorf("attemptDelay(%d failures, max %d) = %v, want %v", tt.failures, tt.maxFailures, got, tt.want)
+		}
+	}
+}
+
+func TestAttemptKeys(t *testing.T) {
+	account := attemptKey(signInAttempts, "account", " Ada@Example.com ")
+	if account != "signin:account:ada@example.com" {
+		t.Errorf("account key = %q", account)
+	}
+	a := attemptPairKey(signInAttempts, "ada@example.com", "192.0.2.1")
+	b := attemptPairKey(signInAttempts, "ada@example.com", "192.0.2.2")
+	if a == b || a == account {
+		t.Errorf("pair keys must differ per IP and from the account key: %q %q", a, b)
+	}
+	if prefix := attemptPairKey(signInAttempts, "ada@example.com", ""); a[:len(prefix)] != prefix {
+		t.Errorf("ClearFailedAttempts prefix %q does not match %q", prefix, a)
+	}
+}
+
+// evalDelayExpr evaluates what attemptDelayExpr builds for a failures count
+func evalDelayExpr(t *testing.T, expr interface{}, failures int) time.Duration {
+	t.Helper()
+	switch e := expr.(type) {
+	case int64:
+		return time.Duration(e) * time.Millisecond
+	case bson.M:
+		sw := e["$switch"].(bson.M)
+		for _, b := range sw["branches"].(bson.A) {
+			branch := b.(bson.M)
+			if branch["case"].(bson.M)["$eq"].(bson.A)[1].(int) == failures {
+				return time.Duration(branch["then"].(int64)) * time.Millisecond
+			}
+		}
+		return time.Duration(sw["default"].(int64)) * time.Millisecond
+	}
+	t.Fatalf("unexpected delay expression %T", expr)
+	return 0
+}
+
+func TestAttemptDelayExprMatchesAttemptDelay(t *testing.T) {
+	policies := []attemptPolicy{signInAttempts, signUpOTPAttempts, twoFactorAttempts, unlockAttempts}
+	for _, policy := range policies {
+		for _, maxFailures := range []int{0, policy.maxFailures, policy.maxFailures * ipFailureFactor} {
+			expr := attemptDelayExpr(policy, maxFailures)
+			for failures := 1; failures <= 200; failures++ {
+				want := attemptDelay(policy, failures, maxFailures)
+				if got := evalDelayExpr(t, expr, failures); got != want {
+					t.Errorf("%s max %d: delay expression at %d failures = %v, want %v", policy.scope, maxFailures, failures, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCountedFailuresRestartsAfterWindow(t *testing.T) {
+	if got := countedFailures(models.LoginAttempt{}); got != 1 {
+		t.Errorf("first attempt counted as %d", got)
+	}
+	live := models.LoginAttempt{Failures: 4, Expires_At: time.Now().Add(time.Hour)}
+	if got := countedFailures(live); got != 5 {
+		t.Errorf("attempt after 4 failures counted as %d", got)
+	}
+	stale := models.LoginAttempt{Failures: 4, Expires_At: time.Now().Add(-time.Minute)}
+	if got := countedFailures(stale); got != 1 {
+		t.Errorf("attempt after an expired window counted as %d", got)
+	}
+}
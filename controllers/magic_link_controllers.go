@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"my-work/config"
+	"my-work/mailer"
+	"my-work/models"
+	"my-work/oidc"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const magicLinkTTL = 15 * time.Minute
+
+// RequestMagicLink emails a single-use sign-in link. The response is the
+// same whether or not the email belongs to an account.
+func RequestMagicLink(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.MagicLinkRequest
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		link, err := url.Parse(app.MagicLinkURL)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sign-in failed", "invalid MAGIC_LINK_URL")
+			return
+		}
+
+		// Throttle and count the request before the lookup so unknown emails
+		// are rate limited exactly like existing accounts
+		if !AllowOTPSend(ctx, mctx, app, req.Email) {
+			return
+		}
+		RecordOTPSend(mctx, app, req.Email, ctx.ClientIP())
+
+		var user models.SetSignUpModel
+		err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"email": req.Email}).Decode(&user)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Printf("Failed to look up user for magic link: %v", err)
+			}
+			SuccessResponse(ctx, "If the account exists, a sign-in link has been sent", nil)
+			return
+		}
+
+		rawToken, err := oidc.RandomString(32)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sign-in failed", err.Error())
+			return
+		}
+		query := link.Query()
+		query.Set("token", rawToken)
+		link.RawQuery = query.Encode()
+
+		now := time.Now()
+		collection := app.Client.Database("talkmore").Collection("magicLinks")
+		_, err = collection.InsertOne(mctx, models.MagicLinkModel{
+			Token_Hash: hashMagicLinkToken(app, rawToken),
+			User_ID:    user.User_ID,
+			Email:      user.Email,
+			IP:         ctx.ClientIP(),
+			Created_At: now,
+			Expires_At: now.Add(magicLinkTTL),
+		})
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sign-in failed", "Failed to save sign-in link")
+			return
+		}
+
+		// Mailed in the background so the response takes as long as it does
+		// for an unknown email; SendMail logs failures
+		go SendMail(app, user.Email, mailer.TemplateMagicLink, gin.H{
+			"Name":      user.First_Name,
+			"Link":      link.String(),
+			"ExpiresIn": "15 minutes",
+		})
+		SuccessResponse(ctx, "If the account exists, a sign-in link has been sent", nil)
+	}
+}
+
+// ExchangeMagicLink trades the token from a sign-in link for a token pair.
+// It is POST only so mail scanners that prefetch links can't use it up.
+func ExchangeMagicLink(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.MagicLinkExchange
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		// Each link can be used once
+		var pending models.MagicLinkModel
+		err := app.Client.Database("talkmore").Collection("magicLinks").FindOneAndDelete(mctx,
+			bson.M{"_id": hashMagicLinkToken(app, req.Token), "expires_at": bson.M{"$gt": time.Now()}},
+		).Decode(&pending)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Printf("Failed to look up magic link: %v", err)
+			}
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid link", "sign-in link expired or already used")
+			return
+		}
+
+		var user models.SetSignUpModel
+		err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": pending.User_ID}).Decode(&user)
+		// The link is only good for the address it was sent to
+		if err != nil || user.Email != pending.Email || isPastDeletion(user) {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid link", "sign-in link expired or already used")
+			return
+		}
+		if rejectRestrictedUser(ctx, user) {
+			return
+		}
+		if user.TOTP_Enabled {
+			TwoFactorChallengeResponse(ctx, mctx, app, user)
+			return
+		}
+
+		tokenPair, err := StartUserSession(ctx, mctx, app, user)
+		if err != nil {
+			startSessionFailed(ctx, err)
+			return
+		}
+		SuccessResponse(ctx, "Signed In Successfully", gin.H{
+			"access_token":  tokenPair.AccessToken,
+			"refresh_token": tokenPair.RefreshToken,
+			"user_id":       user.User_ID,
+		})
+	}
+}
+
+// hashMagicLinkToken keys the token with the app secret so a leaked
+// magicLinks collection can't be turned back into working links
+func hashMagicLinkToken(app *config.AppConfig, rawToken string) string {
+	mac := hmac.New(sha256.New, app.SecretKey)
+	mac.Write([]byte(rawToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errNotMessageSender = errors.New("only the sender can change this message")
+	errMessageDeleted   = errors.New("message was deleted")
+	errMessageChanged   = errors.New("message changed while editing, try again")
+)
+
+// EditMessage replaces the text of one of the caller's messages, keeping the
+// previous text in its edit history
+func EditMessage(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.EditMessage
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		message, err := editChatMessage(mctx, app, ctx.GetString("uid"), ctx.Param("id"), req.Message)
+		if err != nil {
+			messageErrorResponse(ctx, "Failed to edit message", err)
+			return
+		}
+		SuccessResponse(ctx, "Message edited", message)
+	}
+}
+
+// DeleteMessage deletes a message for the caller only (?scope=me, the
+// default) or for both participants (?scope=everyone, sender only)
+func DeleteMessage(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		uid := ctx.GetString("uid")
+		var err error
+		switch scope := ctx.DefaultQuery("scope", models.DeleteForMe); scope {
+		case models.DeleteForMe:
+			err = hideChatMessage(mctx, app, uid, ctx.Param("id"))
+		case models.DeleteForEveryone:
+			err = deleteChatMessage(mctx, app, uid, ctx.Param("id"))
+		default:
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", "scope must be me or everyone")
+			return
+		}
+		if err != nil {
+			messageErrorResponse(ctx, "Failed to delete message", err)
+			return
+		}
+		SuccessResponse(ctx, "Message deleted", gin.H{"message_id": ctx.Param("id")})
+	}
+}
+
+func messageErrorResponse(ctx *gin.Context, title string, err error) {
+	switch err {
+	case errEmptyMessage:
+		ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+	case errMessageNotFound:
+		ErrorResponse(ctx, http.StatusNotFound, "Not found", err.Error())
+	case errNotMessageSender:
+		ErrorResponse(ctx, http.StatusForbidden, "Not allowed", err.Error())
+	case errMessageDeleted, errMessageChanged:
+		ErrorResponse(ctx, http.StatusConflict, title, err.Error())
+	default:
+		ErrorResponse(ctx, http.StatusInternalServerError, title, err.Error())
+	}
+}
+
+// loadOwnMessage loads a message uid can see, either as sender or recipient
+func loadOwnMessage(mctx context.Context, app *config.AppConfig, uid, messageID string) (models.ChatMessage, error) {
+	var message models.ChatMessage
+	err := app.Client.Database("talkmore").Collection("messages").FindOne(mctx, bson.M{
+		"_id":        messageID,
+		"$or":        []bson.M{{"sender_id": uid}, {"recipient_id": uid}},
+		"hidden_for": bson.M{"$ne": uid},
+	}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return message, errMessageNotFound
+	}
+	return message, err
+}
+
+func editChatMessage(mctx context.Context, app *config.AppConfig, uid, messageID, text string) (models.ChatMessage, error) {
+	if strings.TrimSpace(text) == "" {
+		return models.ChatMessage{}, errEmptyMessage
+	}
+	message, err := loadOwnMessage(mctx, app, uid, messageID)
+	if err != nil {
+		return message, err
+	}
+	if message.Sender_ID != uid {
+		return message, errNotMessageSender
+	}
+	if message.Deleted_At != nil {
+		return message, errMessageDeleted
+	}
+	if message.Message == text {
+		return message, nil
+	}
+
+	now := time.Now().UTC()
+	previous := models.MessageEdit{Message: message.Message, Edited_At: now}
+	// Matching on the old text keeps concurrent edits from losing history
+	result, err := app.Client.Database("talkmore").Collection("messages").UpdateOne(mctx,
+		bson.M{"_id": message.ID, "message": message.Message, "deleted_at": bson.M{"$exists": false}},
+		bson.M{
+			"$set":  bson.M{"message": text, "edited_at": now},
+			"$push": bson.M{"edit_history": previous},
+		},
+	)
+	if err != nil {
+		return message, fmt.Errorf("failed to edit message: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return message, errMessageChanged
+	}
+	message.Message = text
+	message.Edited_At = &now
+	message.Edit_History = append(message.Edit_History, previous)
+
+	updateLastMessage(mctx, app, message, text)
+	publishMessageEvent(mctx, app, message, []string{message.Sender_ID, message.Recipient_ID}, models.WebSocketEventEdited, bson.M{
+		"message":   text,
+		"edited_at": now,
+	})
+	return message, nil
+}
+
+// deleteChatMessage replaces one of uid's messages with a tombstone for both
+// participants. The text and its edit history are removed.
+func deleteChatMessage(mctx context.Context, app *config.AppConfig, uid, messageID string) error {
+	message, err := loadOwnMessage(mctx, app, uid, messageID)
+	if err != nil {
+		return err
+	}
+	if message.Sender_ID != uid {
+		return errNotMessageSender
+	}
+	if message.Deleted_At != nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	_, err = app.Client.Database("talkmore").Collection("messages").UpdateOne(mctx,
+		bson.M{"_id": message.ID},
+		bson.M{
+			"$set":   bson.M{"message": "", "deleted_at": now},
+			"$unset": bson.M{"edit_history": "", "edited_at": ""},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+
+	updateLastMessage(mctx, app, message, models.DeletedMessageText)
+	publishMessageEvent(mctx, app, message, []string{message.Sender_ID, message.Recipient_ID}, models.WebSocketEventDeleted, bson.M{
+		"scope":      models.DeleteForEveryone,
+		"deleted_at": now,
+	})
+	return nil
+}
+
+// hideChatMessage deletes a message for uid only. The other participant
+// still sees it.
+func hideChatMessage(mctx context.Context, app *config.AppConfig, uid, messageID string) error {
+	message, err := loadOwnMessage(mctx, app, uid, messageID)
+	if err != nil {
+		return err
+	}
+
+	db := app.Client.Database("talkmore")
+	_, err = db.Collection("messages").UpdateOne(mctx,
+		bson.M{"_id": message.ID},
+		bson.M{"$addToSet": bson.M{"hidden_for": uid}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+
+	_, err = db.Collection("conversations").UpdateOne(mctx,
+		bson.M{"_id": message.Conversation_ID, "last_message_id": message.ID},
+		bson.M{"$addToSet": bson.M{"last_hidden_for": uid}},
+	)
+	if err != nil {
+		log.Printf("Failed to update conversation %s after hiding message %s: %v", message.Conversation_ID, message.ID, err)
+	}
+
+	// Only the caller's other devices need to drop it
+	publishMessageEvent(mctx, app, message, []string{uid}, models.WebSocketEventDeleted, bson.M{
+		"scope": models.DeleteForMe,
+	})
+	return nil
+}
+
+// updateLastMessage refreshes the chat list preview when message is the
+// newest one in its conversation
+func updateLastMessage(mctx context.Context, app *config.AppConfig, message models.ChatMessage, text string) {
+	_, err := app.Client.Database("talkmore").Collection("conversations").UpdateOne(mctx,
+		bson.M{"_id": message.Conversation_ID, "last_message_id": message.ID},
+		bson.M{"$set": bson.M{"last_message": text}},
+	)
+	if err != nil {
+		log.Printf("Failed to update last message of conversation %s: %v", message.Conversation_ID, err)
+	}
+}
+
+func publishMessageEvent(mctx context.Context, app *config.AppConfig, message models.ChatMessage, userIDs []string, eventType string, fields bson.M) {
+	fields["conversation_id"] = message.Conversation_ID
+	fields["message_id"] = message.ID
+	for _, userID := range userIDs {
+		if err := PushWebSocketEvent(mctx, app, userID, eventType, fields); err != nil {
+			log.Printf("Failed to send %s event to user %s: %v", eventType, userID, err)
+		}
+	}
+}
+
+// lastVisibleMessage is the newest message in the conversation that uid
+// hasn't deleted for themselves, for chat list previews
+func lastVisibleMessage(mctx context.Context, app *config.AppConfig, conversation models.Conversation, uid string) (string, error) {
+	if !slices.Contains(conversation.Last_Hidden_For, uid) {
+		return conversation.Last_Message, nil
+	}
+	var message models.ChatMessage
+	err := app.Client.Database("talkmore").Collection("messages").FindOne(mctx,
+		bson.M{"conversation_id": conversation.ID, "hidden_for": bson.M{"$ne": uid}},
+		options.FindOne().SetSort(bson.D{{Key: "date", Value: -1}}),
+	).Decode(&message)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", nil
+		}
+		return "", err
+	}
+	if message.Deleted_At != nil {
+		return models.DeletedMessageText, nil
+	}
+	return message.Message, nil
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"my-work/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AdminSuspendUser blocks the user until the given time
+func AdminSuspendUser(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req models.SuspendUser
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		if !req.Until.After(time.Now()) {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", "until must be in the future")
+			return
+		}
+		until := req.Until.UTC()
+		restrictUser(ctx, app, models.ModerationSuspend, req.Reason, &until)
+	}
+}
+
+// AdminBanUser blocks the user permanently
+func AdminBanUser(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req models.BanUser
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+		restrictUser(ctx, app, models.ModerationBan, req.Reason, nil)
+	}
+}
+
+// restrictUser stores the suspension or ban, records it in the moderation
+// history, signs the user out everywhere and drops their live sockets
+func restrictUser(ctx *gin.Context, app *config.AppConfig, action, reason string, until *time.Time) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	target, ok := loadModerationTarget(ctx, mctx, app)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	restriction := models.Restriction{
+		Action:       action,
+		Reason:       reason,
+		Moderator_ID: ctx.GetString("uid"),
+		Created_At:   now,
+		Until:        until,
+	}
+	_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+		bson.M{"user_id": target.User_ID},
+		bson.M{"$set": bson.M{"restriction": restriction, "updated_at": now}},
+	)
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Failed to restrict user", err.Error())
+		return
+	}
+	recordModerationAction(mctx, app, target.User_ID, restriction)
+
+	if err := token.RevokeAllSessions(mctx, app, target.User_ID); err != nil {
+		log.Printf("Failed to revoke sessions of restricted user %s: %v", target.User_ID, err)
+	}
+	app.Principals.InvalidateUser(target.User_ID)
+	app.Hub.DisconnectUser(target.User_ID, restrictionMessage(&restriction))
+
+	SuccessResponse(ctx, "Restriction applied", gin.H{"user_id": target.User_ID, "restriction": restriction})
+}
+
+// AdminLiftRestriction ends a suspension or ban early
+func AdminLiftRestriction(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.LiftRestriction
+		if err := ctx.ShouldBindJSON(&req); err != nil && ctx.Request.ContentLength > 0 {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		target, ok := loadModerationTarget(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if target.Restriction == nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Not restricted", "user is not suspended or banned")
+			return
+		}
+
+		_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": target.User_ID},
+			bson.M{
+				"$unset": bson.M{"restriction": ""},
+				"$set":   bson.M{"updated_at": time.Now()},
+			},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to lift restriction", err.Error())
+			return
+		}
+		recordModerationAction(mctx, app, target.User_ID, models.Restriction{
+			Action:       models.ModerationLift,
+			Reason:       req.Reason,
+			Moderator_ID: ctx.GetString("uid"),
+			Created_At:   time.Now(),
+		})
+		app.Principals.InvalidateUser(target.User_ID)
+
+		SuccessResponse(ctx, "Restriction lifted", gin.H{"user_id": target.User_ID})
+	}
+}
+
+// AdminModerationHistory lists the user's suspensions, bans and lifts,
+// newest first
+func AdminModerationHistory(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+		cursor, err := app.Client.Database("talkmore").Collection("moderationActions").Find(mctx, bson.M{"user_id": ctx.Param("id")}, opts)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		history := []models.ModerationAction{}
+		if err := cursor.All(mctx, &history); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		SuccessResponse(ctx, "Moderation history", history)
+	}
+}
+
+// loadModerationTarget loads the :id user and makes sure the caller outranks
+// them, so moderators can't act on admins or on each other
+func loadModerationTarget(ctx *gin.Context, mctx context.Context, app *config.AppConfig) (models.SetSignUpModel, bool) {
+	var target models.SetSignUpModel
+	userID := ctx.Param("id")
+	if userID == ctx.GetString("uid") {
+		ErrorResponse(ctx, http.StatusBadRequest, "Not allowed", "you can't moderate your own account")
+		return target, false
+	}
+
+	err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": userID}).Decode(&target)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			ErrorResponse(ctx, http.StatusNotFound, "User not found", "no user with this id")
+		} else {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+		}
+		return target, false
+	}
+	if models.RoleAtLeast(target.Role, ctx.GetString("role")) {
+		ErrorResponse(ctx, http.StatusForbidden, "Not allowed", "you can only moderate users below your role")
+		return target, false
+	}
+	return target, true
+}
+
+func recordModerationAction(mctx context.Context, app *config.AppConfig, uid string, restriction models.Restriction) {
+	_, err := app.Client.Database("talkmore").Collection("moderationActions").InsertOne(mctx, models.ModerationAction{
+		ID:           primitive.NewObjectID(),
+		User_ID:      uid,
+		Action:       restriction.Action,
+		Reason:       restriction.Reason,
+		Moderator_ID: restriction.Moderator_ID,
+		Created_At:   restriction.Created_At,
+		Until:        restriction.Until,
+	})
+	if err != nil {
+		log.Printf("Failed to record %s of user %s: %v", restriction.Action, uid, err)
+	}
+}
+
+func restrictionMessage(restriction *models.Restriction) string {
+	if restriction.Action == models.ModerationBan {
+		return "account banned"
+	}
+	return "account suspended"
+}
+
+// RestrictionError is the body sent to a suspended or banned user
+func RestrictionError(restriction *models.Restriction) gin.H {
+	return gin.H{
+		"error":  restrictionMessage(restriction),
+		"code":   restriction.ErrorCode(),
+		"reason": restriction.Reason,
+		"until":  restriction.Until,
+	}
+}
+
+// rejectRestrictedUser stops a suspended or banned user from signing in. It
+// writes a 403 with the error code and reason and returns true.
+func rejectRestrictedUser(ctx *gin.Context, user models.SetSignUpModel) bool {
+	if !user.Restriction.Active(time.Now()) {
+		return false
+	}
+	ErrorResponse(ctx, http.StatusForbidden, restrictionMessage(user.Restriction), gin.H{
+		"code":   user.Restriction.ErrorCode(),
+		"reason": user.Restriction.Reason,
+		"until":  user.Restriction.Until,
+	})
+	return true
+}
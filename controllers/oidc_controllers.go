@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"my-work/oidc"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	// oidcBindingCookie carries the login's binding so a callback only
+	// completes in the browser that started it, not one lured to a link
+	oidcBindingCookie = "oidc_binding"
+	oidcCookiePath    = "/oidc/"
+)
+
+// OIDCLogin starts the authorization code flow with the named provider. It
+// redirects, or with ?mode=json returns the URL for apps that open it themselves
+// along with the binding they must send back to the callback.
+func OIDCLogin(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		provider, ok := app.OIDCProviders[ctx.Param("provider")]
+		if !ok {
+			ErrorResponse(ctx, http.StatusNotFound, "Unknown provider", "sign-in provider is not configured")
+			return
+		}
+
+		pending := models.OIDCState{Provider: provider.Name, Expires_At: time.Now().Add(oidcStateTTL)}
+		var err error
+		for _, field := range []*string{&pending.State, &pending.Nonce, &pending.Verifier, &pending.Binding} {
+			if *field, err = oidc.RandomString(32); err != nil {
+				ErrorResponse(ctx, http.StatusInternalServerError, "Sign-in failed", err.Error())
+				return
+			}
+		}
+
+		authURL, err := provider.AuthCodeURL(mctx, pending.State, pending.Nonce, pending.Verifier)
+		if err != nil {
+			log.Printf("OIDC login with %s failed: %v", provider.Name, err)
+			ErrorResponse(ctx, http.StatusBadGateway, "Sign-in failed", "provider is unavailable")
+			return
+		}
+
+		collection := app.Client.Database("talkmore").Collection("oidcStates")
+		if _, err := collection.InsertOne(mctx, pending); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sign-in failed", err.Error())
+			return
+		}
+
+		// Lax so the cookie survives the top-level redirect back from the provider
+		ctx.SetSameSite(http.SameSiteLaxMode)
+		ctx.SetCookie(oidcBindingCookie, pending.Binding, int(oidcStateTTL.Seconds()), oidcCookiePath, "", true, true)
+
+		if ctx.Query("mode") == "json" {
+			SuccessResponse(ctx, "Open the authorization URL", gin.H{"authorization_url": authURL, "binding": pending.Binding})
+			return
+		}
+		ctx.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// OIDCCallback finishes the flow: it exchanges the code, verifies the ID
+// token, links or creates the user and issues our own token pair. The code
+// and state can come in the query string (browser redirect) or a JSON body,
+// and must be presented with the binding from OIDCLogin.
+func OIDCCallback(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		provider, ok := app.OIDCProviders[ctx.Param("provider")]
+		if !ok {
+			ErrorResponse(ctx, http.StatusNotFound, "Unknown provider", "sign-in provider is not configured")
+			return
+		}
+		if errCode := ctx.Query("error"); errCode != "" {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Sign-in cancelled", errCode)
+			return
+		}
+
+		var callback models.OIDCCallback
+		if ctx.Request.Method == http.MethodPost {
+			if err := ctx.ShouldBindJSON(&callback); err != nil {
+				ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+				return
+			}
+		} else {
+			callback.Code, callback.State = ctx.Query("code"), ctx.Query("state")
+		}
+		if callback.Code == "" || callback.State == "" {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", "code and state are required")
+			return
+		}
+		binding := callback.Binding
+		if binding == "" {
+			binding, _ = ctx.Cookie(oidcBindingCookie)
+		}
+		ctx.SetSameSite(http.SameSiteLaxMode)
+		ctx.SetCookie(oidcBindingCookie, "", -1, oidcCookiePath, "", true, true)
+		if binding == "" {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Sign-in failed", "sign-in was not started here, please try again")
+			return
+		}
+
+		// Each state can be used once, and only by whoever started it
+		var pending models.OIDCState
+		err := app.Client.Database("talkmore").Collection("oidcStates").FindOneAndDelete(mctx, bson.M{
+			"state":      callback.State,
+			"provider":   provider.Name,
+			"binding":    binding,
+			"expires_at": bson.M{"$gt": time.Now()},
+		}).Decode(&pending)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Sign-in failed", "sign-in expired, please try again")
+			return
+		}
+
+		tokens, err := provider.Exchange(mctx, callback.Code, pending.Verifier)
+		if err != nil {
+			log.Printf("OIDC code exchange with %s failed: %v", provider.Name, err)
+			ErrorResponse(ctx, http.StatusUnauthorized, "Sign-in failed", "could not verify the sign-in with the provider")
+			return
+		}
+		claims, err := provider.VerifyIDToken(mctx, tokens.IDToken, pending.Nonce)
+		if err != nil {
+			log.Printf("OIDC id_token from %s rejected: %v", provider.Name, err)
+			ErrorResponse(ctx, http.StatusUnauthorized, "Sign-in failed", "could not verify the sign-in with the provider")
+			return
+		}
+
+		user, err := findOrCreateOIDCUser(mctx, app, provider.Name, claims)
+		if mongo.IsDuplicateKeyError(err) {
+			// Someone signed up with the email while this account was created
+			ErrorResponse(ctx, http.StatusConflict, "Sign-in failed", "an account with this email was just created, please sign in again")
+			return
+		}
+		if err != nil {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Sign-in failed", err.Error())
+			return
+		}
+		if isPastDeletion(user) {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "account has been deleted")
+			return
+		}
+		if rejectRestrictedUser(ctx, user) {
+			return
+		}
+		if user.TOTP_Enabled {
+			TwoFactorChallengeResponse(ctx, mctx, app, user)
+			return
+		}
+
+		tokenPair, err := StartUserSession(ctx, mctx, app, user)
+		if err != nil {
+			startSessionFailed(ctx, err)
+			return
+		}
+		SuccessResponse(ctx, "Signed In Successfully", gin.H{
+			"access_token":  tokenPair.AccessToken,
+			"refresh_token": tokenPair.RefreshToken,
+			"user_id":       user.User_ID,
+		})
+	}
+}
+
+type oidcSignInError string
+
+func (e oidcSignInError) Error() string { return string(e) }
+
+// findOrCreateOIDCUser resolves the provider identity to a users row: an
+// already linked account first, then an account with the same verified
+// email (which gets linked), otherwise a new account
+func findOrCreateOIDCUser(mctx context.Context, app *config.AppConfig, providerName string, claims *oidc.IDTokenClaims) (models.SetSignUpModel, error) {
+	users := app.Client.Database("talkmore").Collection("users")
+
+	var user models.SetSignUpModel
+	identity := bson.M{"oidc_identities": bson.M{"$elemMatch": bson.M{"provider": providerName, "subject": claims.Subject}}}
+	err := users.FindOne(mctx, identity).Decode(&user)
+	if err == nil {
+		return user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	email := strings.TrimSpace(claims.Email)
+	if email == "" || !bool(claims.EmailVerified) {
+		return user, oidcSignInError("the provider did not share a verified email address")
+	}
+
+	link := models.OIDCIdentity{Provider: providerName, Subject: claims.Subject, Linked_At: time.Now()}
+	err = users.FindOne(mctx, bson.M{"email": email}).Decode(&user)
+	if err == nil {
+		_, err = users.UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID},
+			bson.M{
+				"$push": bson.M{"oidc_identities": link},
+				"$set":  bson.M{"is_varified": true, "updated_at": time.Now()},
+			},
+		)
+		return user, err
+	}
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" {
+		firstName, lastName, _ = strings.Cut(claims.Name, " ")
+	}
+	now := time.Now()
+	user = models.SetSignUpModel{
+		ID:              primitive.NewObjectID(),
+		First_Name:      firstName,
+		Last_Name:       lastName,
+		Email:           email,
+		Created_At:      now,
+		Updated_At:      now,
+		IsVarified:      true,
+		Role:            models.RoleUser,
+		OIDC_Identities: []models.OIDCIdentity{link},
+	}
+	user.User_ID = user.ID.Hex()
+	if claims.Picture != "" {
+		user.Profile_Url = &claims.Picture
+	}
+	_, err = users.InsertOne(mctx, user)
+	return user, err
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"my-work/config"
+	"my-work/models"
+	"my-work/oidc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestOIDCCallbackRequiresBinding(t *testing.T) {
+	app := &config.AppConfig{OIDCProviders: map[string]*oidc.Provider{
+		"mock": oidc.NewProvider(oidc.Config{Name: "mock", Issuer: "https://issuer.example.com"}),
+	}}
+	router := gin.New()
+	router.GET("/oidc/:provider/callback", OIDCCallback(app))
+	router.POST("/oidc/:provider/callback", OIDCCallback(app))
+
+	requests := map[string]*http.Request{
+		// A link someone else started, opened in a browser without our cookie
+		"redirect": httptest.NewRequest(http.MethodGet, "/oidc/mock/callback?code=c&state=s", nil),
+		// An app that did not echo the binding
+		"json": httptest.NewRequest(http.MethodPost, "/oidc/mock/callback", strings.NewReader(`{"code":"c","state":"s"}`)),
+	}
+	for name, req := range requests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want 401: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestConfirmIdentity(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		user     models.SetSignUpModel
+		password string
+		want     bool
+		code     string
+	}{
+		{"right password", models.SetSignUpModel{User_ID: "u1", Password: hash}, "correct horse", true, ""},
+		{"wrong password", models.SetSignUpModel{User_ID: "u1", Password: hash}, "wrong", false, ""},
+		{"no password given", models.SetSignUpModel{User_ID: "u1", Password: hash}, "", false, ""},
+		// Without a session there is no recent sign-in to lean on
+		{"passwordless without session", models.SetSignUpModel{User_ID: "u2"}, "", false, "reauth_required"},
+		{"passwordless ignores password", models.SetSignUpModel{User_ID: "u2"}, "anything", false, "reauth_required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			if got := confirmIdentity(ctx, ctx, &config.AppConfig{}, tt.user, tt.password); got != tt.want {
+				t.Fatalf("confirmIdentity = %v, want %v", got, tt.want)
+			}
+			if tt.want {
+				return
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", w.Code)
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("response %s does not carry %q", w.Body, tt.code)
+			}
+		})
+	}
+}
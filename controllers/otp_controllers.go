@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	otpTTL                  = 5 * time.Minute
+	otpCooldown             = 60 * time.Second
+	otpSendWindow           = 24 * time.Hour
+	maxOTPSendsPerRecipient = 5
+	maxOTPSendsPerIP        = 20
+	// maxCodeGuesses is how many times one emailed or texted code may be
+	// tried before a new one has to be requested
+	maxCodeGuesses = 4
+)
+
+// ResendOTP issues a fresh sign-up OTP for an existing tempData row instead
+// of making the client submit the whole sign-up again
+func ResendOTP(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.ResendOTP
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		collection := app.Client.Database("talkmore").Collection("tempData")
+		var tempUser models.GetSignUpModel
+		err := collection.FindOne(mctx, bson.M{"user_id": req.ID}).Decode(&tempUser)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				ErrorResponse(ctx, http.StatusNotFound, "Not data found", "sign-up expired, please sign up again")
+			} else {
+				ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			}
+			return
+		}
+
+		_, identifier := signUpIdentifier(tempUser)
+		if !AllowOTPSend(ctx, mctx, app, identifier) {
+			return
+		}
+
+		otp, err := Generate_OTP()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", err.Error())
+			return
+		}
+
+		now := time.Now()
+		_, err = collection.UpdateOne(mctx, bson.M{"user_id": req.ID}, bson.M{"$set": bson.M{
+			"otp_hash":     HashOTP(app, otp),
+			"last_sent_at": now,
+			"expires_at":   now.Add(otpTTL),
+			"failures":     0,
+		}})
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Temperory users", "Failed to update temporary user")
+			return
+		}
+
+		if !sendOTP(app, tempUser.Email, tempUser.Phone, tempUser.First_Name, otp, "5 minutes") {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", "Failed to Send OTP")
+			return
+		}
+		RecordOTPSend(mctx, app, identifier, ctx.ClientIP())
+
+		SuccessResponse(ctx, "OTP sent again", gin.H{"user_id": tempUser.User_ID})
+	}
+}
+
+// takeCodeGuess uses up one of a code's guesses and decodes the code
+// document matching filter into code. Taking the guess is a single
+// conditional $inc, so concurrent requests can't try a code more than
+// maxCodeGuesses times between them. It returns mongo.ErrNoDocuments when
+// there is no code or its guesses are used up.
+func takeCodeGuess(mctx context.Context, collection *mongo.Collection, filter bson.M, code interface{}) error {
+	guarded := bson.M{"failures": bson.M{"$not": bson.M{"$gte": maxCodeGuesses}}}
+	for key, value := range filter {
+		guarded[key] = value
+	}
+	after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	return collection.FindOneAndUpdate(mctx, guarded, bson.M{"$inc": bson.M{"failures": 1}}, after).Decode(code)
+}
+
+// dropSpentCode deletes a code after a wrong guess once it has no guesses
+// left. A code issued since the guess has fresh guesses and is kept.
+func dropSpentCode(mctx context.Context, collection *mongo.Collection, filter bson.M, failures int) {
+	if failures < maxCodeGuesses {
+		return
+	}
+	spent := bson.M{"failures": bson.M{"$gte": maxCodeGuesses}}
+	for key, value := range filter {
+		spent[key] = value
+	}
+	if _, err := collection.DeleteOne(mctx, spent); err != nil {
+		log.Printf("Failed to delete used up code in %s: %v", collection.Name(), err)
+	}
+}
+
+// AllowOTPSend enforces the per-recipient cooldown and the daily caps per
+// recipient (email or phone) and per IP. When the send isn't allowed it
+// writes a 429 and returns false.
+func AllowOTPSend(ctx *gin.Context, mctx context.Context, app *config.AppConfig, recipient string) bool {
+	retryAfter, err := otpSendRetryAfter(mctx, app, recipient, ctx.ClientIP())
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", err.Error())
+		return false
+	}
+	if retryAfter > 0 {
+		seconds := int(retryAfter.Round(time.Second) / time.Second)
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		ErrorResponse(ctx, http.StatusTooManyRequests, "Too many OTP requests", gin.H{"retry_after_seconds": seconds})
+		return false
+	}
+	return true
+}
+
+// otpSendRetryAfter returns how long the caller has to wait before another
+// OTP may be sent; zero means a send is allowed now
+func otpSendRetryAfter(mctx context.Context, app *config.AppConfig, recipient, ip string) (time.Duration, error) {
+	collection := app.Client.Database("talkmore").Collection("otpSends")
+	now := time.Now()
+	windowStart := now.Add(-otpSendWindow)
+
+	var last models.OTPSend
+	latest := options.FindOne().SetSort(bson.D{{Key: "sent_at", Value: -1}})
+	err := collection.FindOne(mctx, bson.M{"recipient": recipient}, latest).Decode(&last)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+	if err == nil && now.Sub(last.Sent_At) < otpCooldown {
+		return otpCooldown - now.Sub(last.Sent_At), nil
+	}
+
+	limits := []struct {
+		field string
+		value string
+		max   int64
+	}{
+		{"recipient", recipient, maxOTPSendsPerRecipient},
+		{"ip", ip, maxOTPSendsPerIP},
+	}
+	for _, limit := range limits {
+		filter := bson.M{limit.field: limit.value, "sent_at": bson.M{"$gt": windowStart}}
+		count, err := collection.CountDocuments(mctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		if count < limit.max {
+			continue
+		}
+		// The cap frees up once the oldest send in the window ages out
+		var oldest models.OTPSend
+		earliest := options.FindOne().SetSort(bson.D{{Key: "sent_at", Value: 1}})
+		if err := collection.FindOne(mctx, filter, earliest).Decode(&oldest); err != nil {
+			return 0, err
+		}
+		return oldest.Sent_At.Add(otpSendWindow).Sub(now), nil
+	}
+	return 0, nil
+}
+
+// RecordOTPSend counts a sent OTP towards the cooldown and daily caps
+func RecordOTPSend(mctx context.Context, app *config.AppConfig, recipient, ip string) {
+	collection := app.Client.Database("talkmore").Collection("otpSends")
+
+	now := time.Now()
+	_, err := collection.InsertOne(mctx, models.OTPSend{
+		Recipient:  recipient,
+		IP:         ip,
+		Sent_At:    now,
+		Expires_At: now.Add(otpSendWindow),
+	})
+	if err != nil {
+		log.Printf("Failed to record OTP send for %s: %v", recipient, err)
+	}
+}
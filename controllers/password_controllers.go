@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/mailer"
+	"my-work/models"
+	"my-work/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const passwordResetTTL = 10 * time.Minute
+
+// ForgotPassword emails a reset OTP. The response is the same whether or not
+// the email belongs to an account so it can't be used to probe for users.
+func ForgotPassword(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.ForgotPassword
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		// Throttle and count the request before the lookup so unknown emails
+		// are rate limited exactly like existing accounts
+		if !AllowOTPSend(ctx, mctx, app, req.Email) {
+			return
+		}
+		RecordOTPSend(mctx, app, req.Email, ctx.ClientIP())
+
+		var user models.SetSignUpModel
+		err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"email": req.Email}).Decode(&user)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Printf("Failed to look up user for password reset: %v", err)
+			}
+			SuccessResponse(ctx, "If the account exists, a reset code has been sent", nil)
+			return
+		}
+
+		otp, err := Generate_OTP()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In OTP", err.Error())
+			return
+		}
+		reset := models.PasswordResetModel{
+			User_ID:    user.User_ID,
+			Email:      user.Email,
+			OTP_Hash:   HashOTP(app, otp),
+			Expires_At: time.Now().Add(passwordResetTTL),
+		}
+
+		collection := app.Client.Database("talkmore").Collection("passwordResets")
+		_, err = collection.ReplaceOne(mctx, bson.M{"user_id": user.User_ID}, reset, options.Replace().SetUpsert(true))
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Password reset", "Failed to save reset code")
+			return
+		}
+
+		// Mailed in the background so the response takes as long as it does
+		// for an unknown email; SendMail logs failures
+		go SendMail(app, user.Email, mailer.TemplatePasswordReset, gin.H{
+			"Name":      user.First_Name,
+			"OTP":       otp,
+			"ExpiresIn": "10 minutes",
+		})
+		SuccessResponse(ctx, "If the account exists, a reset code has been sent", nil)
+	}
+}
+
+// ResetPassword checks the reset OTP, stores the new password and revokes
+// every token issued before the reset
+func ResetPassword(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.ResetPassword
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		attempt, ok := ReserveAttempt(ctx, mctx, app, resetOTPAttempts, req.Email)
+		if !ok {
+			return
+		}
+
+		collection := app.Client.Database("talkmore").Collection("passwordResets")
+		var reset models.PasswordResetModel
+		err := takeCodeGuess(mctx, collection, bson.M{"email": req.Email}, &reset)
+		if err != nil && err != mongo.ErrNoDocuments {
+			attempt.Release(mctx)
+			ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			return
+		}
+		if err == mongo.ErrNoDocuments || !CheckOTPHash(app, req.OTP, reset.OTP_Hash) {
+			if err == nil {
+				dropSpentCode(mctx, collection, bson.M{"email": req.Email}, reset.Failures)
+			}
+			attempt.Fail()
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid OTP", "Reset code expired or not matched")
+			return
+		}
+		attempt.Succeed(mctx)
+
+		var user models.SetSignUpModel
+		err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": reset.User_ID}).Decode(&user)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			return
+		}
+		if !checkPasswordPolicy(ctx, app, req.Password, user.First_Name, user.Last_Name, user.Email, user.Phone) {
+			return
+		}
+
+		password, err := HashPassword(req.Password)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In Hashing", err.Error())
+			return
+		}
+
+		_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(
+			mctx,
+			bson.M{"user_id": reset.User_ID},
+			bson.M{"$set": bson.M{
+				"password":   password,
+				"updated_at": time.Now(),
+			}},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to reset password", err.Error())
+			return
+		}
+
+		// Sign every device out so tokens issued before the reset stop working
+		if err := token.RevokeAllSessions(mctx, app, reset.User_ID); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke sessions", err.Error())
+			return
+		}
+
+		if _, err := collection.DeleteOne(mctx, bson.M{"user_id": reset.User_ID}); err != nil {
+			log.Printf("Failed to delete used reset code for user %s: %v", reset.User_ID, err)
+		}
+
+		SuccessResponse(ctx, "Password reset successfully", nil)
+	}
+}
+
+// ChangePassword sets a new password after checking the current one and
+// signs out every other session
+func ChangePassword(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.ChangePassword
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if !CheckPasswordHash(req.Current_Password, user.Password) {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "current password is incorrect")
+			return
+		}
+		if req.New_Password == req.Current_Password {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", "new password must differ from the current one")
+			return
+		}
+		if !checkPasswordPolicy(ctx, app, req.New_Password, user.First_Name, user.Last_Name, user.Email, user.Phone) {
+			return
+		}
+
+		password, err := HashPassword(req.New_Password)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Error In Hashing", err.Error())
+			return
+		}
+		_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID},
+			bson.M{"$set": bson.M{"password": password, "updated_at": time.Now()}},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to change password", err.Error())
+			return
+		}
+
+		if err := token.RevokeOtherSessions(mctx, app, user.User_ID, ctx.GetString("sid")); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke sessions", err.Error())
+			return
+		}
+		SuccessResponse(ctx, "Password changed", nil)
+	}
+}
+
+// checkPasswordPolicy runs the configured password policy. personal holds the
+// user's names, email and phone. On violations it writes a 400 listing them
+// and returns false.
+func checkPasswordPolicy(ctx *gin.Context, app *config.AppConfig, password string, personal ...string) bool {
+	if app.PasswordPolicy == nil {
+		return true
+	}
+	violations := app.PasswordPolicy.Check(password, personal...)
+	if len(violations) == 0 {
+		return true
+	}
+	ErrorResponse(ctx, http.StatusBadRequest, "Password rejected", gin.H{"violations": violations})
+	return false
+}
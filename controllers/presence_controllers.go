@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"my-work/config"
+	"my-work/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxPresenceQuery = 100
+	// maxPresencePeers bounds how many recent chat partners hear about a
+	// presence change
+	maxPresencePeers = 500
+)
+
+// GetPresence returns the presence of the users in ?user_ids= (comma
+// separated). Only the caller and users they have a conversation with are
+// included.
+func GetPresence(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		uid := ctx.GetString("uid")
+		var requested []string
+		for _, id := range strings.Split(ctx.Query("user_ids"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				requested = append(requested, id)
+			}
+		}
+		if len(requested) == 0 {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", "user_ids is required")
+			return
+		}
+		if len(requested) > maxPresenceQuery {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", "too many user_ids")
+			return
+		}
+
+		conversationIDs := make([]string, 0, len(requested))
+		for _, id := range requested {
+			conversationIDs = append(conversationIDs, models.ConversationID(uid, id))
+		}
+		cursor, err := app.Client.Database("talkmore").Collection("conversations").Find(mctx,
+			bson.M{"_id": bson.M{"$in": conversationIDs}},
+			options.Find().SetProjection(bson.M{"participants": 1}),
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		var conversations []models.Conversation
+		if err := cursor.All(mctx, &conversations); err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+			return
+		}
+		allowed := map[string]bool{uid: true}
+		for _, conversation := range conversations {
+			allowed[conversationPeer(conversation, uid)] = true
+		}
+
+		result := []models.Presence{}
+		var offline []string
+		for _, id := range requested {
+			if !allowed[id] {
+				continue
+			}
+			p, err := app.PubSub.Presence(mctx, id)
+			if err != nil {
+				ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+				return
+			}
+			if p.Status == models.PresenceOffline {
+				offline = append(offline, id)
+			} else {
+				result = append(result, p)
+			}
+		}
+		if len(offline) > 0 {
+			lastSeen, err := lastSeenTimes(mctx, app, offline)
+			if err != nil {
+				ErrorResponse(ctx, http.StatusInternalServerError, "Sorry! Server Error", err.Error())
+				return
+			}
+			for _, id := range offline {
+				result = append(result, models.Presence{User_ID: id, Status: models.PresenceOffline, Last_Seen: lastSeen[id]})
+			}
+		}
+		SuccessResponse(ctx, "Presence", result)
+	}
+}
+
+// ChatPeerIDs returns the users uid has most recently chatted with
+func ChatPeerIDs(mctx context.Context, app *config.AppConfig, uid string) ([]string, error) {
+	opts := options.Find().
+		SetProjection(bson.M{"participants": 1}).
+		SetSort(bson.D{{Key: "last_message_at", Value: -1}}).
+		SetLimit(maxPresencePeers)
+	cursor, err := app.Client.Database("talkmore").Collection("conversations").Find(mctx, bson.M{"participants": uid}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var conversations []models.Conversation
+	if err := cursor.All(mctx, &conversations); err != nil {
+		return nil, err
+	}
+	peers := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		if peer := conversationPeer(conversation, uid); peer != uid {
+			peers = append(peers, peer)
+		}
+	}
+	return peers, nil
+}
+
+// IsConversationParticipant reports whether the conversation exists and uid
+// takes part in it
+func IsConversationParticipant(mctx context.Context, app *config.AppConfig, uid, conversationID string) (bool, error) {
+	count, err := app.Client.Database("talkmore").Collection("conversations").CountDocuments(mctx,
+		bson.M{"_id": conversationID, "participants": uid},
+		options.Count().SetLimit(1),
+	)
+	return count > 0, err
+}
+
+// SaveLastSeen records when the user's last connection went away
+func SaveLastSeen(mctx context.Context, app *config.AppConfig, uid string, lastSeen time.Time) error {
+	_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+		bson.M{"user_id": uid},
+		bson.M{"$set": bson.M{"last_seen_at": lastSeen}},
+	)
+	return err
+}
+
+func lastSeenTimes(mctx context.Context, app *config.AppConfig, uids []string) (map[string]*time.Time, error) {
+	opts := options.Find().SetProjection(bson.M{"user_id": 1, "last_seen_at": 1})
+	cursor, err := app.Client.Database("talkmore").Collection("users").Find(mctx, bson.M{"user_id": bson.M{"$in": uids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.SetSignUpModel
+	if err := cursor.All(mctx, &users); err != nil {
+		return nil, err
+	}
+	lastSeen := make(map[string]*time.Time, len(users))
+	for _, user := range users {
+		lastSeen[user.User_ID] = user.Last_Seen_At
+	}
+	return lastSeen, nil
+}
@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errConversationNotFound = errors.New("conversation not found")
+	errMessageNotFound      = errors.New("message not found in this conversation")
+)
+
+// ReadConversation marks the :id conversation read up to message_id, or up
+// to its newest message when no id is given
+func ReadConversation(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.MarkRead
+		// The body is optional
+		if err := ctx.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		cursor, err := MarkConversationRead(mctx, app, ctx.GetString("uid"), ctx.Param("id"), req.Message_ID)
+		if err != nil {
+			if err == errConversationNotFound || err == errMessageNotFound {
+				ErrorResponse(ctx, http.StatusNotFound, "Not found", err.Error())
+				return
+			}
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to mark conversation read", err.Error())
+			return
+		}
+		SuccessResponse(ctx, "Conversation marked read", cursor)
+	}
+}
+
+// MarkConversationRead moves uid's read cursor in the conversation forward
+// to messageID (the newest message when empty) and sends the other
+// participant a seen receipt. Cursors never move back; the current cursor is
+// returned either way.
+func MarkConversationRead(mctx context.Context, app *config.AppConfig, uid, conversationID, messageID string) (models.ReadCursor, error) {
+	db := app.Client.Database("talkmore")
+
+	var conversation models.Conversation
+	err := db.Collection("conversations").FindOne(mctx, bson.M{"_id": conversationID, "participants": uid}).Decode(&conversation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.ReadCursor{}, errConversationNotFound
+		}
+		return models.ReadCursor{}, err
+	}
+
+	filter := bson.M{"conversation_id": conversationID}
+	if messageID != "" {
+		filter["_id"] = messageID
+	}
+	var message models.ChatMessage
+	latest := options.FindOne().SetSort(bson.D{{Key: "date", Value: -1}, {Key: "_id", Value: -1}})
+	err = db.Collection("messages").FindOne(mctx, filter, latest).Decode(&message)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.ReadCursor{}, errMessageNotFound
+		}
+		return models.ReadCursor{}, err
+	}
+
+	cursor := models.ReadCursor{
+		Message_ID:   message.ID,
+		Message_Date: message.Date,
+		Read_At:      time.Now().UTC(),
+	}
+	field := "read_cursors." + uid
+	result, err := db.Collection("conversations").UpdateOne(mctx,
+		bson.M{"_id": conversationID, "$or": []bson.M{
+			{field: bson.M{"$exists": false}},
+			{field + ".message_date": bson.M{"$lt": message.Date}},
+			{field + ".message_date": message.Date, field + ".message_id": bson.M{"$lt": message.ID}},
+		}},
+		bson.M{"$set": bson.M{field: cursor}},
+	)
+	if err != nil {
+		return models.ReadCursor{}, fmt.Errorf("failed to save read cursor: %w", err)
+	}
+	if result.ModifiedCount == 0 {
+		// Already read at least this far
+		return conversation.Read_Cursors[uid], nil
+	}
+
+	peer := conversationPeer(conversation, uid)
+	if peer != uid {
+		err := PushWebSocketEvent(mctx, app, peer, models.WebSocketEventSeen, bson.M{
+			"conversation_id": conversationID,
+			"reader_id":       uid,
+			"message_id":      cursor.Message_ID,
+			"message_date":    cursor.Message_Date,
+			"read_at":         cursor.Read_At,
+		})
+		if err != nil {
+			log.Printf("Failed to send seen receipt to user %s: %v", peer, err)
+		}
+	}
+	return cursor, nil
+}
+
+// unreadCounts counts, per conversation, the messages uid received after
+// their read cursor, leaving out deleted ones. One aggregation covers the
+// whole page of conversations.
+func unreadCounts(mctx context.Context, app *config.AppConfig, conversations []models.Conversation, uid string) (map[string]int64, error) {
+	cursor, err := app.Client.Database("talkmore").Collection("messages").Aggregate(mctx, mongo.Pipeline{
+		{{Key: "$match", Value: unreadFilter(conversations, uid)}},
+		{{Key: "$group", Value: bson.M{"_id": "$conversation_id", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ConversationID string `bson:"_id"`
+		Count          int64  `bson:"count"`
+	}
+	if err := cursor.All(mctx, &groups); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(groups))
+	for _, group := range groups {
+		counts[group.ConversationID] = group.Count
+	}
+	return counts, nil
+}
+
+// unreadFilter matches the messages uid hasn't read in the conversations
+func unreadFilter(conversations []models.Conversation, uid string) bson.M {
+	unread := make([]bson.M, 0, len(conversations))
+	for _, conversation := range conversations {
+		filter := bson.M{"conversation_id": conversation.ID}
+		if cursor, ok := conversation.Read_Cursors[uid]; ok {
+			filter["$or"] = afterReadCursor(cursor)
+		}
+		unread = append(unread, filter)
+	}
+	return bson.M{
+		"$or":          unread,
+		"recipient_id": uid,
+		"deleted_at":   bson.M{"$exists": false},
+		"hidden_for":   bson.M{"$ne": uid},
+	}
+}
+
+// afterReadCursor matches messages after the cursor. Messages can share a
+// date, so ties are ordered by _id the way the cursor was picked.
+func afterReadCursor(cursor models.ReadCursor) []bson.M {
+	return []bson.M{
+		{"date": bson.M{"$gt": cursor.Message_Date}},
+		{"date": cursor.Message_Date, "_id": bson.M{"$gt": cursor.Message_ID}},
+	}
+}
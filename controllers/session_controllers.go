@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"my-work/config"
+	"my-work/mailer"
+	"my-work/models"
+	"my-work/token"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionMetaFromRequest collects the device details stored on a new session.
+// Clients name the device with the X-Device-Name header.
+func SessionMetaFromRequest(ctx *gin.Context) models.SessionMeta {
+	deviceName := ctx.GetHeader("X-Device-Name")
+	if deviceName == "" {
+		deviceName = "Unknown device"
+	}
+	return models.SessionMeta{
+		DeviceName: deviceName,
+		IP:         ctx.ClientIP(),
+		UserAgent:  ctx.Request.UserAgent(),
+	}
+}
+
+// StartUserSession opens a session for the user on the requesting device and
+// emails a new-device alert when the device hasn't been seen before (phone
+// accounts without an email get no alert). Signing in also cancels a pending
+// account deletion.
+func StartUserSession(ctx *gin.Context, mctx context.Context, app *config.AppConfig, user models.SetSignUpModel) (models.TokenPair, error) {
+	meta := SessionMetaFromRequest(ctx)
+	newDevice := token.IsNewDevice(mctx, app, user.User_ID, meta)
+
+	if err := restoreDeletedAccount(mctx, app, user); err != nil {
+		return models.TokenPair{}, err
+	}
+	tokenPair, err := token.StartSession(mctx, app, user, meta)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+
+	if newDevice && user.Email != "" {
+		go SendMail(app, user.Email, mailer.TemplateNewDevice, gin.H{
+			"Name":   user.First_Name,
+			"Device": meta.DeviceName + " (" + meta.UserAgent + ")",
+			"IP":     meta.IP,
+			"Time":   time.Now().UTC().Format(time.RFC1123),
+		})
+	}
+	return tokenPair, nil
+}
+
+// startSessionFailed answers a StartUserSession error. An account purged
+// or due for purging while signing in gets the same answer as a wrong
+// password.
+func startSessionFailed(ctx *gin.Context, err error) {
+	if errors.Is(err, errAccountDeleted) {
+		ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "invalid login or password")
+		return
+	}
+	ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+}
+
+func ListSessions(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		sessions, err := token.ListSessions(mctx, app, ctx.GetString("uid"))
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to load sessions", err.Error())
+			return
+		}
+		currentID := ctx.GetString("sid")
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == currentID
+		}
+		SuccessResponse(ctx, "Your sessions", sessions)
+	}
+}
+
+func RevokeSession(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		revoked, err := token.RevokeSession(mctx, app, ctx.GetString("uid"), ctx.Param("id"))
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to revoke session", err.Error())
+			return
+		}
+		if !revoked {
+			ErrorResponse(ctx, http.StatusNotFound, "Session not found", "no active session with this id")
+			return
+		}
+		SuccessResponse(ctx, "Session revoked", gin.H{"session_id": ctx.Param("id")})
+	}
+}
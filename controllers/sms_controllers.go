@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"my-work/config"
+	"my-work/mailer"
+	"my-work/models"
+	"my-work/sms"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SendSMS delivers a text message to an E.164 phone number
+func SendSMS(app *config.AppConfig, phone, body string) bool {
+	mctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := app.SMS.Send(mctx, sms.Message{To: phone, Body: body}); err != nil {
+		log.Printf("Failed to send SMS to %s: %v", phone, err)
+		return false
+	}
+	return true
+}
+
+// sendOTP texts the code to phone when set, otherwise emails it
+func sendOTP(app *config.AppConfig, email, phone, name string, otp int, expiresIn string) bool {
+	if phone != "" {
+		return SendSMS(app, phone, fmt.Sprintf("Your talkmore verification code is %d. It expires in %s.", otp, expiresIn))
+	}
+	return SendMail(app, email, mailer.TemplateOTP, gin.H{
+		"Name":      name,
+		"OTP":       otp,
+		"ExpiresIn": expiresIn,
+	})
+}
+
+// signUpIdentifier returns the users field a sign-up is keyed by: phone for
+// phone sign-ups, email otherwise
+func signUpIdentifier(details models.GetSignUpModel) (string, string) {
+	if details.Phone != "" {
+		return "phone", details.Phone
+	}
+	return "email", details.Email
+}
+
+// loginIdentifier picks the users field to sign in with. Exactly one of
+// email and phone must be given; the phone is normalised to E.164.
+func loginIdentifier(email, phone string) (string, string, error) {
+	email = strings.TrimSpace(email)
+	switch {
+	case email != "" && phone != "":
+		return "", "", errors.New("sign in with either email or phone, not both")
+	case email != "":
+		return "email", email, nil
+	case phone != "":
+		normalized, err := sms.NormalizePhone(phone)
+		if err != nil {
+			return "", "", err
+		}
+		return "phone", normalized, nil
+	default:
+		return "", "", errors.New("email or phone is required")
+	}
+}
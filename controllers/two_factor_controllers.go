@@ -0,0 +1,399 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"my-work/token"
+	"my-work/totp"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	totpIssuer         = "talkmore"
+	twoFactorChallenge = 5 * time.Minute
+	recoveryCodeCount  = 10
+	// maxChallengeFailures wrong codes use up a challenge
+	maxChallengeFailures = 5
+	// reauthWindow is how recently an account without a password must have
+	// signed in to make sensitive changes
+	reauthWindow = 10 * time.Minute
+)
+
+var errChallengeUsed = errors.New("challenge expired, sign in again")
+
+// SetupTwoFactor starts TOTP enrollment. The secret stays pending until the
+// user proves their authenticator works with ConfirmTwoFactor.
+func SetupTwoFactor(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if user.TOTP_Enabled {
+			ErrorResponse(ctx, http.StatusConflict, "Two-factor already enabled", "disable it before setting up a new authenticator")
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Two-factor setup failed", err.Error())
+			return
+		}
+		_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID},
+			bson.M{"$set": bson.M{"totp_pending_secret": secret, "updated_at": time.Now()}},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Two-factor setup failed", err.Error())
+			return
+		}
+
+		SuccessResponse(ctx, "Scan the URI with your authenticator app", gin.H{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+		})
+	}
+}
+
+// ConfirmTwoFactor enables TOTP once the user submits a valid code and hands
+// back the recovery codes. They are only ever shown here.
+func ConfirmTwoFactor(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.TwoFactorCode
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if user.TOTP_Pending_Secret == "" {
+			ErrorResponse(ctx, http.StatusBadRequest, "Two-factor not started", "call /api/2fa/setup first")
+			return
+		}
+		step, valid := totp.Match(user.TOTP_Pending_Secret, req.Code, time.Now())
+		if !valid {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid code", "code does not match the authenticator")
+			return
+		}
+
+		codes, hashes, err := generateRecoveryCodes()
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Two-factor setup failed", err.Error())
+			return
+		}
+		_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID},
+			bson.M{
+				"$set": bson.M{
+					"totp_enabled":   true,
+					"totp_secret":    user.TOTP_Pending_Secret,
+					"totp_last_step": step,
+					"recovery_codes": hashes,
+					"updated_at":     time.Now(),
+				},
+				"$unset": bson.M{"totp_pending_secret": ""},
+			},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Two-factor setup failed", err.Error())
+			return
+		}
+
+		SuccessResponse(ctx, "Two-factor authentication enabled", gin.H{"recovery_codes": codes})
+	}
+}
+
+// DisableTwoFactor turns TOTP off. It needs the password (or a recent sign-in
+// for accounts without one) and a current code or recovery code so a stolen
+// access token alone can't remove it.
+func DisableTwoFactor(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.TwoFactorDisable
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		user, ok := loadCurrentUser(ctx, mctx, app)
+		if !ok {
+			return
+		}
+		if !user.TOTP_Enabled {
+			ErrorResponse(ctx, http.StatusBadRequest, "Two-factor not enabled", "nothing to disable")
+			return
+		}
+		if !confirmIdentity(ctx, mctx, app, user, req.Password) {
+			return
+		}
+		if !VerifySecondFactor(mctx, app, user, req.Code, req.RecoveryCode) {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid code", "two-factor code not accepted")
+			return
+		}
+
+		_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID},
+			bson.M{
+				"$set": bson.M{"totp_enabled": false, "updated_at": time.Now()},
+				"$unset": bson.M{
+					"totp_secret":         "",
+					"totp_pending_secret": "",
+					"totp_last_step":      "",
+					"recovery_codes":      "",
+				},
+			},
+		)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Failed to disable two-factor", err.Error())
+			return
+		}
+		SuccessResponse(ctx, "Two-factor authentication disabled", nil)
+	}
+}
+
+// SignInTwoFactor completes a SignIn that returned 2fa_required
+func SignInTwoFactor(app *config.AppConfig) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var req models.TwoFactorSignIn
+		if err := ctx.BindJSON(&req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Parsing Error", err.Error())
+			return
+		}
+		if err := app.Validator.Struct(req); err != nil {
+			ErrorResponse(ctx, http.StatusBadRequest, "Validation Error", err.Error())
+			return
+		}
+
+		claims, err := token.ValidateChallengeToken(req.ChallengeToken, token.PurposeTwoFactor, app)
+		if err != nil {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid challenge", errChallengeUsed.Error())
+			return
+		}
+		attempt, ok := ReserveAttempt(ctx, mctx, app, twoFactorAttempts, claims.UID)
+		if !ok {
+			return
+		}
+
+		challenges := app.Client.Database("talkmore").Collection("twoFactorChallenges")
+		count, err := challenges.CountDocuments(mctx, bson.M{"_id": claims.ID, "user_id": claims.UID})
+		if err != nil {
+			attempt.Release(mctx)
+			ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			return
+		}
+		if count == 0 {
+			attempt.Release(mctx)
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid challenge", errChallengeUsed.Error())
+			return
+		}
+
+		var user models.SetSignUpModel
+		err = app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": claims.UID}).Decode(&user)
+		// Past the grace period the account is only waiting to be purged
+		if err != nil || !user.TOTP_Enabled || isPastDeletion(user) {
+			attempt.Release(mctx)
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid challenge", errChallengeUsed.Error())
+			return
+		}
+		if !VerifySecondFactor(mctx, app, user, req.Code, req.RecoveryCode) {
+			attempt.Fail()
+			failChallenge(mctx, app, claims.ID)
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid code", "two-factor code not accepted")
+			return
+		}
+		attempt.Succeed(mctx)
+
+		// Consume the challenge; of two racing requests only one gets tokens
+		result, err := challenges.DeleteOne(mctx, bson.M{"_id": claims.ID})
+		if err != nil {
+			ErrorResponse(ctx, http.StatusInternalServerError, "Something else", err.Error())
+			return
+		}
+		if result.DeletedCount == 0 {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid challenge", errChallengeUsed.Error())
+			return
+		}
+		if rejectRestrictedUser(ctx, user) {
+			return
+		}
+
+		tokenPair, err := StartUserSession(ctx, mctx, app, user)
+		if err != nil {
+			startSessionFailed(ctx, err)
+			return
+		}
+		SuccessResponse(ctx, "Signed In Successfully", gin.H{
+			"access_token":  tokenPair.AccessToken,
+			"refresh_token": tokenPair.RefreshToken,
+			"user_id":       user.User_ID,
+		})
+	}
+}
+
+// TwoFactorChallengeResponse answers a correct password for a user with TOTP
+// enabled: no tokens yet, only a single-use challenge to exchange at
+// /signin/2fa
+func TwoFactorChallengeResponse(ctx *gin.Context, mctx context.Context, app *config.AppConfig, user models.SetSignUpModel) {
+	challenge, jti, err := token.GenerateChallengeToken(user.User_ID, token.PurposeTwoFactor, twoFactorChallenge, app)
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+		return
+	}
+	_, err = app.Client.Database("talkmore").Collection("twoFactorChallenges").InsertOne(mctx, models.TwoFactorChallenge{
+		ID:         jti,
+		User_ID:    user.User_ID,
+		Expires_At: time.Now().Add(twoFactorChallenge),
+	})
+	if err != nil {
+		ErrorResponse(ctx, http.StatusInternalServerError, "Failed to generate tokens", err.Error())
+		return
+	}
+	SuccessResponse(ctx, "Two-factor authentication required", gin.H{
+		"2fa_required":    true,
+		"challenge_token": challenge,
+		"expires_in":      int(twoFactorChallenge / time.Second),
+	})
+}
+
+// failChallenge counts a wrong code against a challenge and drops the
+// challenge once it has seen maxChallengeFailures of them
+func failChallenge(mctx context.Context, app *config.AppConfig, jti string) {
+	challenges := app.Client.Database("talkmore").Collection("twoFactorChallenges")
+	var challenge models.TwoFactorChallenge
+	err := challenges.FindOneAndUpdate(mctx,
+		bson.M{"_id": jti},
+		bson.M{"$inc": bson.M{"failures": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&challenge)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to count wrong code for challenge %s: %v", jti, err)
+		}
+		return
+	}
+	if challenge.Failures >= maxChallengeFailures {
+		if _, err := challenges.DeleteOne(mctx, bson.M{"_id": jti}); err != nil {
+			log.Printf("Failed to drop challenge %s: %v", jti, err)
+		}
+	}
+}
+
+// VerifySecondFactor accepts either a TOTP code that hasn't been used yet or
+// an unused recovery code, burning whichever one was used
+func VerifySecondFactor(mctx context.Context, app *config.AppConfig, user models.SetSignUpModel, code, recoveryCode string) bool {
+	users := app.Client.Database("talkmore").Collection("users")
+
+	if code != "" {
+		step, valid := totp.Match(user.TOTP_Secret, code, time.Now())
+		if !valid {
+			return false
+		}
+		// Only move forward so a code can't be replayed inside its window
+		result, err := users.UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID, "totp_last_step": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"totp_last_step": step}},
+		)
+		return err == nil && result.ModifiedCount == 1
+	}
+
+	if recoveryCode != "" {
+		result, err := users.UpdateOne(mctx,
+			bson.M{"user_id": user.User_ID, "recovery_codes": hashRecoveryCode(recoveryCode)},
+			bson.M{"$pull": bson.M{"recovery_codes": hashRecoveryCode(recoveryCode)}},
+		)
+		return err == nil && result.ModifiedCount == 1
+	}
+	return false
+}
+
+// loadCurrentUser fetches the authenticated user's full record
+func loadCurrentUser(ctx *gin.Context, mctx context.Context, app *config.AppConfig) (models.SetSignUpModel, bool) {
+	var user models.SetSignUpModel
+	err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": ctx.GetString("uid")}).Decode(&user)
+	if err != nil {
+		ErrorResponse(ctx, http.StatusUnauthorized, "User not found", err.Error())
+		return user, false
+	}
+	return user, true
+}
+
+// confirmIdentity checks that the caller is the account holder before a
+// sensitive change. Accounts with a password must give it. Accounts created
+// through an OIDC provider have none, so their current session must have
+// started within reauthWindow; signing in again with the provider renews it.
+func confirmIdentity(ctx *gin.Context, mctx context.Context, app *config.AppConfig, user models.SetSignUpModel, password string) bool {
+	if user.Password != "" {
+		if !CheckPasswordHash(password, user.Password) {
+			ErrorResponse(ctx, http.StatusUnauthorized, "Invalid credentials", "Password Not Matched")
+			return false
+		}
+		return true
+	}
+
+	claims := &models.SigningDetails{UID: user.User_ID, SID: ctx.GetString("sid")}
+	session, err := token.ValidateSession(mctx, app, claims)
+	if err == nil && time.Since(session.Created_At) <= reauthWindow {
+		return true
+	}
+	ErrorResponse(ctx, http.StatusUnauthorized, "Sign in again", gin.H{
+		"code":    "reauth_required",
+		"message": "sign in again with your provider to confirm this change",
+	})
+	return false
+}
+
+// generateRecoveryCodes returns the plain codes for the user and their hashes for storage
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
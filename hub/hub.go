@@ -0,0 +1,262 @@
+// Package hub fans WebSocket events out to the connections of this instance.
+// Events travel through a pubsub.PubSub, so they reach the user's
+// connections on every instance. Each connection gets a buffered send queue;
+// a connection that falls so far behind that its queue fills up is evicted
+// instead of holding up everyone else.
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"my-work/pubsub"
+	"sync"
+	"time"
+)
+
+// publishTimeout bounds a publish through the backend
+const publishTimeout = 5 * time.Second
+
+// WebSocket close codes used when the hub ends a connection
+const (
+	CloseNormal          = 1000
+	ClosePolicyViolation = 1008
+	CloseTryAgainLater   = 1013
+)
+
+// Client is one registered connection. Its writer drains Send until Done is
+// closed, then closes the socket with CloseReason.
+type Client struct {
+	UserID string
+
+	send        chan []byte
+	done        chan struct{}
+	once        sync.Once
+	closeCode   int
+	closeReason string
+}
+
+// Send is the connection's queue of encoded events
+func (c *Client) Send() <-chan []byte {
+	return c.send
+}
+
+// Done is closed when the connection is unregistered, evicted or
+// disconnected
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// CloseReason returns the close code and reason once Done is closed
+func (c *Client) CloseReason() (int, string) {
+	<-c.done
+	return c.closeCode, c.closeReason
+}
+
+// SendJSON queues v for this connection only. It reports false when the
+// queue is full.
+func (c *Client) SendJSON(v interface{}) bool {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	return c.enqueue(msg)
+}
+
+func (c *Client) enqueue(msg []byte) bool {
+	select {
+	case <-c.done:
+		return true
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) close(code int, reason string) {
+	c.once.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		close(c.done)
+	})
+}
+
+// Hub tracks the registered connections per user. A nil *Hub drops
+// everything, so code paths without live connections need no checks.
+type Hub struct {
+	mu         sync.RWMutex
+	clients    map[string]map[*Client]struct{}
+	broadcasts map[string]func(payload []byte)
+	queueSize  int
+	backend    pubsub.PubSub
+}
+
+// New returns a hub giving every connection a queue of queueSize events. It
+// starts delivering from backend, or from an in-memory backend when nil.
+func New(queueSize int, backend pubsub.PubSub) (*Hub, error) {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	if backend == nil {
+		backend = pubsub.NewMemory()
+	}
+	h := &Hub{
+		clients:    map[string]map[*Client]struct{}{},
+		broadcasts: map[string]func(payload []byte){},
+		queueSize:  queueSize,
+		backend:    backend,
+	}
+	if err := backend.Start(h.deliver); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Register adds a connection for the user
+func (h *Hub) Register(userID string) *Client {
+	queueSize := 1
+	if h != nil {
+		queueSize = h.queueSize
+	}
+	c := &Client{
+		UserID: userID,
+		send:   make(chan []byte, queueSize),
+		done:   make(chan struct{}),
+	}
+	if h == nil {
+		return c
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = map[*Client]struct{}{}
+		h.backend.Subscribe(userID)
+	}
+	h.clients[userID][c] = struct{}{}
+	return c
+}
+
+// Unregister removes a connection whose socket has gone away
+func (h *Hub) Unregister(c *Client) {
+	h.remove(c, CloseNormal, "")
+}
+
+// Publish sends v, encoded once as JSON, to every connection of the user on
+// every instance
+func (h *Hub) Publish(userID string, v interface{}) error {
+	if h == nil {
+		return nil
+	}
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.publish(pubsub.Message{User_ID: userID, Kind: pubsub.KindEvent, Payload: msg})
+}
+
+// DisconnectUser closes every connection of the user on every instance,
+// e.g. when the account is suspended
+func (h *Hub) DisconnectUser(userID, reason string) {
+	if h == nil {
+		return
+	}
+	msg := pubsub.Message{User_ID: userID, Kind: pubsub.KindDisconnect, Payload: []byte(reason)}
+	if err := h.publish(msg); err != nil {
+		log.Printf("Failed to publish disconnect of user %s: %v", userID, err)
+		// Still close the sockets we hold
+		h.deliver(msg)
+	}
+}
+
+// HandleBroadcast runs fn for every Broadcast of kind, from any instance.
+// Broadcasts are for instance state such as caches, not for connections.
+func (h *Hub) HandleBroadcast(kind string, fn func(payload []byte)) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.broadcasts[kind] = fn
+}
+
+// Broadcast sends payload to the kind's handler on every instance, this one
+// included
+func (h *Hub) Broadcast(kind string, payload []byte) error {
+	if h == nil {
+		return nil
+	}
+	return h.publish(pubsub.Message{User_ID: pubsub.AllInstances, Kind: kind, Payload: payload})
+}
+
+func (h *Hub) publish(msg pubsub.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	return h.backend.Publish(ctx, msg)
+}
+
+// deliver hands a message from the backend to this instance's connections.
+// Connections whose queue is full are evicted.
+func (h *Hub) deliver(msg pubsub.Message) {
+	if msg.User_ID == pubsub.AllInstances {
+		h.mu.RLock()
+		fn := h.broadcasts[msg.Kind]
+		h.mu.RUnlock()
+		if fn != nil {
+			fn(msg.Payload)
+		}
+		return
+	}
+	if msg.Kind == pubsub.KindDisconnect {
+		h.mu.RLock()
+		clients := make([]*Client, 0, len(h.clients[msg.User_ID]))
+		for c := range h.clients[msg.User_ID] {
+			clients = append(clients, c)
+		}
+		h.mu.RUnlock()
+		for _, c := range clients {
+			h.remove(c, ClosePolicyViolation, string(msg.Payload))
+		}
+		return
+	}
+
+	var slow []*Client
+	h.mu.RLock()
+	for c := range h.clients[msg.User_ID] {
+		if !c.enqueue(msg.Payload) {
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range slow {
+		h.remove(c, CloseTryAgainLater, "connection too slow")
+	}
+}
+
+// Connected reports whether the user has a connection to this instance
+func (h *Hub) Connected(userID string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[userID]) > 0
+}
+
+func (h *Hub) remove(c *Client, code int, reason string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	if clients := h.clients[c.UserID]; clients != nil {
+		if _, ok := clients[c]; ok {
+			delete(clients, c)
+			if len(clients) == 0 {
+				delete(h.clients, c.UserID)
+				h.backend.Unsubscribe(c.UserID)
+			}
+		}
+	}
+	h.mu.Unlock()
+	c.close(code, reason)
+}
@@ -0,0 +1,167 @@
+package hub
+
+import (
+	"testing"
+)
+
+// received drains what is queued for c
+func received(c *Client) []string {
+	var out []string
+	for {
+		select {
+		case msg := <-c.Send():
+			out = append(out, string(msg))
+		default:
+			return out
+		}
+	}
+}
+
+func closed(c *Client) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueSize int
+		publish   int
+		// what each of u1's two connections should receive
+		want   int
+		closed bool
+		code   int
+	}{
+		{"delivered to every connection", 4, 2, 2, false, 0},
+		{"fills the queue exactly", 2, 2, 2, false, 0},
+		{"slow connection evicted", 2, 3, 2, true, CloseTryAgainLater},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(tt.queueSize, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, b := h.Register("u1"), h.Register("u1")
+			other := h.Register("u2")
+
+			for i := 0; i < tt.publish; i++ {
+				if err := h.Publish("u1", map[string]int{"n": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, c := range []*Client{a, b} {
+				if got := received(c); len(got) != tt.want || got[0] != `{"n":0}` {
+					t.Errorf("connection received %v, want %d events", got, tt.want)
+				}
+				if closed(c) != tt.closed {
+					t.Errorf("closed = %v, want %v", closed(c), tt.closed)
+				}
+				if tt.closed {
+					if code, _ := c.CloseReason(); code != tt.code {
+						t.Errorf("close code = %d, want %d", code, tt.code)
+					}
+				}
+			}
+			if got := received(other); len(got) != 0 || closed(other) {
+				t.Errorf("another user's connection received %v", got)
+			}
+			if h.Connected("u1") == tt.closed {
+				t.Errorf("Connected(u1) = %v after eviction %v", h.Connected("u1"), tt.closed)
+			}
+		})
+	}
+}
+
+func TestDisconnectAndUnregister(t *testing.T) {
+	tests := []struct {
+		name   string
+		end    func(h *Hub, c *Client)
+		code   int
+		reason string
+	}{
+		{"unregister", func(h *Hub, c *Client) { h.Unregister(c) }, CloseNormal, ""},
+		{"disconnect user", func(h *Hub, c *Client) { h.DisconnectUser(c.UserID, "account suspended") }, ClosePolicyViolation, "account suspended"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(4, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := h.Register("u1")
+			tt.end(h, c)
+			if !closed(c) {
+				t.Fatal("connection still open")
+			}
+			if code, reason := c.CloseReason(); code != tt.code || reason != tt.reason {
+				t.Errorf("CloseReason = %d %q, want %d %q", code, reason, tt.code, tt.reason)
+			}
+			if h.Connected("u1") {
+				t.Error("user still connected")
+			}
+			// A closed connection swallows events instead of reporting a full queue
+			if !c.SendJSON("late") {
+				t.Error("SendJSON on a closed connection reported a full queue")
+			}
+			// Unregistering again is harmless
+			h.Unregister(c)
+		})
+	}
+}
+
+func TestSendJSONQueueFull(t *testing.T) {
+	h, err := New(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := h.Register("u1")
+	if !c.SendJSON("first") {
+		t.Fatal("first event refused")
+	}
+	if c.SendJSON("second") {
+		t.Error("event queued past the queue size")
+	}
+	if closed(c) {
+		t.Error("SendJSON evicted the connection")
+	}
+}
+
+func TestNilHub(t *testing.T) {
+	var h *Hub
+	c := h.Register("u1")
+	if err := h.Publish("u1", "event"); err != nil {
+		t.Fatal(err)
+	}
+	h.DisconnectUser("u1", "bye")
+	h.Unregister(c)
+	if h.Connected("u1") {
+		t.Error("nil hub reports a connection")
+	}
+	if err := h.Broadcast("cache", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroadcastReachesHandlerWithoutSubscription(t *testing.T) {
+	h, err := New(4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	h.HandleBroadcast("cache", func(payload []byte) { got = append(got, string(payload)) })
+
+	if err := h.Broadcast("cache", []byte("drop u1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Broadcast("other", []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "drop u1" {
+		t.Fatalf("handler got %q", got)
+	}
+}
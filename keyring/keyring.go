@@ -0,0 +1,133 @@
+// Package keyring holds the asymmetric keys used to sign JWTs. One key is
+// active and signs new tokens; retired keys are kept so tokens they signed
+// keep verifying until they expire.
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Key is one signing key. Private is nil for keys that can only verify.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+type Keyring struct {
+	active *Key
+	keys   map[string]*Key
+	order  []string
+}
+
+// Load reads the active private key and any retired keys from PEM files.
+// Retired keys may be private or public keys.
+func Load(activePath string, retiredPaths []string) (*Keyring, error) {
+	active, err := loadKey(activePath)
+	if err != nil {
+		return nil, err
+	}
+	if active.Private == nil {
+		return nil, fmt.Errorf("active signing key %s is not a private key", activePath)
+	}
+
+	ring := &Keyring{active: active, keys: map[string]*Key{}}
+	ring.add(active)
+	for _, path := range retiredPaths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		ring.add(key)
+	}
+	return ring, nil
+}
+
+func (k *Keyring) add(key *Key) {
+	if _, exists := k.keys[key.ID]; exists {
+		return
+	}
+	k.keys[key.ID] = key
+	k.order = append(k.order, key.ID)
+}
+
+// Active returns the key new tokens are signed with
+func (k *Keyring) Active() *Key {
+	return k.active
+}
+
+// Lookup finds a key by its kid
+func (k *Keyring) Lookup(kid string) (*Key, bool) {
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s: %w", path, err)
+	}
+
+	key, err := newKey(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func newKey(parsed interface{}) (*Key, error) {
+	key := &Key{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+	if rsaKey, ok := key.Public.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must be at least 2048 bits")
+	}
+
+	jwk, err := publicJWK(key.Public)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.thumbprint()
+	return key, nil
+}
@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+)
+
+// Message is a rendered email ready to be handed to a Mailer
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers rendered messages to their recipients
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var ErrNoRecipients = errors.New("mailer: message has no recipients")
+
+// withDefaultFrom fills in the sender when the message does not carry one
+func withDefaultFrom(msg Message, from string) (Message, error) {
+	if len(msg.To) == 0 {
+		return msg, ErrNoRecipients
+	}
+	if msg.From == "" {
+		msg.From = from
+	}
+	return msg, nil
+}
+
+// envelopeAddress strips the display name so the address can be used in SMTP commands
+func envelopeAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	return parsed.Address, nil
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SpoolMailer writes every message into a maildir (tmp/new/cur) instead of
+// delivering it. Use it for local development and tests.
+type SpoolMailer struct {
+	Dir  string
+	From string
+}
+
+func NewSpoolMailer(dir, from string) (*SpoolMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create mail spool: %w", err)
+		}
+	}
+	return &SpoolMailer{Dir: dir, From: from}, nil
+}
+
+func (m *SpoolMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := withDefaultFrom(msg, m.From)
+	if err != nil {
+		return err
+	}
+	body, err := buildMIME(msg)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%s.talkmore", time.Now().UnixNano(), hex.EncodeToString(suffix))
+
+	// Write to tmp and rename so readers never see a partial file
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, body, 0o644); err != nil {
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
@@ -0,0 +1,184 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"sync"
+	texttemplate "text/template"
+)
+
+// Template names understood by Render
+const (
+	TemplateOTP           = "otp"
+	TemplatePasswordReset = "password_reset"
+	TemplateNewDevice     = "new_device"
+	TemplateDataExport    = "data_export"
+	TemplateEmailChanged  = "email_changed"
+	TemplateAccountUnlock = "account_unlock"
+	TemplateMagicLink     = "magic_link"
+)
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]emailTemplate{}
+)
+
+func init() {
+	MustRegister(TemplateOTP,
+		"Your talkmore verification code",
+		`Hello {{.Name}},
+
+Your talkmore verification code is {{.OTP}}. It expires in {{.ExpiresIn}}.
+Please keep it confidential.
+`,
+		`<p>Hello {{.Name}},</p>
+<p>Your talkmore verification code is <strong>{{.OTP}}</strong>. It expires in {{.ExpiresIn}}.</p>
+<p>Please keep it confidential.</p>
+`)
+
+	MustRegister(TemplatePasswordReset,
+		"Reset your talkmore password",
+		`Hello {{.Name}},
+
+Someone asked to reset the password of your talkmore account.
+Your reset code is {{.OTP}}. It expires in {{.ExpiresIn}}.
+
+If this wasn't you, you can ignore this email.
+`,
+		`<p>Hello {{.Name}},</p>
+<p>Someone asked to reset the password of your talkmore account.</p>
+<p>Your reset code is <strong>{{.OTP}}</strong>. It expires in {{.ExpiresIn}}.</p>
+<p>If this wasn't you, you can ignore this email.</p>
+`)
+
+	MustRegister(TemplateNewDevice,
+		"New sign-in to your talkmore account",
+		`Hello {{.Name}},
+
+Your account was just signed in from a new device.
+
+Device: {{.Device}}
+IP address: {{.IP}}
+Time: {{.Time}}
+
+If this wasn't you, change your password and sign out of your other sessions.
+`,
+		`<p>Hello {{.Name}},</p>
+<p>Your account was just signed in from a new device.</p>
+<ul>
+<li>Device: {{.Device}}</li>
+<li>IP address: {{.IP}}</li>
+<li>Time: {{.Time}}</li>
+</ul>
+<p>If this wasn't you, change your password and sign out of your other sessions.</p>
+`)
+
+	MustRegister(TemplateDataExport,
+		"Your talkmore data export is ready",
+		`Hello {{.Name}},
+
+The copy of your talkmore data you asked for is ready:
+
+{{.Link}}
+
+The link expires on {{.ExpiresAt}}. After that you'll need to request a new export.
+`,
+		`<p>Hello {{.Name}},</p>
+<p>The copy of your talkmore data you asked for is ready:</p>
+<p><a href="{{.Link}}">Download your data</a></p>
+<p>The link expires on {{.ExpiresAt}}. After that you'll need to request a new export.</p>
+`)
+
+	MustRegister(TemplateEmailChanged,
+		"Your talkmore email address was changed",
+		`Hello {{.Name}},
+
+The email address of your talkmore account was changed to {{.NewEmail}}.
+From now on, sign in with the new address.
+
+If you didn't make this change, reply to this email straight away.
+`,
+		`<p>Hello {{.Name}},</p>
+<p>The email address of your talkmore account was changed to <strong>{{.NewEmail}}</strong>.
+From now on, sign in with the new address.</p>
+<p>If you didn't make this change, reply to this email straight away.</p>
+`)
+
+	MustRegister(TemplateAccountUnlock,
+		"Unlock your talkmore account",
+		`Hello {{.Name}},
+
+Sign-in to your talkmore account was paused after too many failed attempts.
+Your unlock code is {{.OTP}}. It expires in {{.ExpiresIn}}.
+
+If those attempts weren't you, consider changing your password.
+`,
+		`<p>Hello {{.Name}},</p>
+<p>Sign-in to your talkmore account was paused after too many failed attempts.</p>
+<p>Your unlock code is <strong>{{.OTP}}</strong>. It expires in {{.ExpiresIn}}.</p>
+<p>If those attempts weren't you, consider changing your password.</p>
+`)
+
+	MustRegister(TemplateMagicLink,
+		"Your talkmore sign-in link",
+		`Hello {{.Name}},
+
+Use this link to sign in to talkmore:
+
+{{.Link}}
+
+The link works once and expires in {{.ExpiresIn}}.
+If you didn't ask to sign in, you can ignore this email.
+`,
+		`<p>Hello {{.Name}},</p>
+<p><a href="{{.Link}}">Sign in to talkmore</a></p>
+<p>The link works once and expires in {{.ExpiresIn}}.</p>
+<p>If you didn't ask to sign in, you can ignore this email.</p>
+`)
+}
+
+// MustRegister adds a named template with subject, plain-text and HTML bodies
+func MustRegister(name, subject, text, html string) {
+	tmpl := emailTemplate{
+		subject: texttemplate.Must(texttemplate.New(name + ".subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name + ".txt").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name + ".html").Parse(html)),
+	}
+	templatesMu.Lock()
+	templates[name] = tmpl
+	templatesMu.Unlock()
+}
+
+// Render executes the named template and returns a message without recipients
+func Render(name string, data interface{}) (Message, error) {
+	templatesMu.RLock()
+	tmpl, ok := templates[name]
+	templatesMu.RUnlock()
+	if !ok {
+		return Message{}, fmt.Errorf("mailer: unknown template %q", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return Message{}, fmt.Errorf("render %s subject: %w", name, err)
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return Message{}, fmt.Errorf("render %s text: %w", name, err)
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return Message{}, fmt.Errorf("render %s html: %w", name, err)
+	}
+
+	return Message{
+		Subject: subject.String(),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
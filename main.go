@@ -4,7 +4,9 @@ import (
 	"context"
 	"log"
 	"my-work/config"
+	"my-work/controllers"
 	"my-work/middleware"
+	"my-work/models"
 	"my-work/routes"
 	"net/http"
 	"os"
@@ -33,6 +35,24 @@ func main() {
 			log.Printf("Error disconnecting MongoDB client: %v", err)
 		}
 	}()
+	defer func() {
+		if err := app.PubSub.Close(); err != nil {
+			log.Printf("Error closing PubSub: %v", err)
+		}
+	}()
+
+	if err := controllers.EnsureTTLIndexes(app); err != nil {
+		log.Fatalf("Failed to create TTL indexes: %v", err)
+	}
+	if err := controllers.EnsureChatIndexes(app); err != nil {
+		log.Fatalf("Failed to create chat indexes: %v", err)
+	}
+	if err := controllers.EnsureUserIndexes(app); err != nil {
+		log.Fatalf("Failed to create user indexes: %v", err)
+	}
+
+	// Purge accounts whose deletion grace period has run out
+	controllers.StartAccountPurger(app, time.Hour)
 
 	// Get port from environment or default to 8000
 	port := os.Getenv("PORT")
@@ -53,6 +73,11 @@ func main() {
 	routes.UserRoutes(authorized, app)
 	routes.WebSocketRoutes(authorized, app)
 
+	// Admin routes (moderators and admins only)
+	admin := router.Group("/api/admin")
+	admin.Use(middleware.RequireAuthWithRole(app, models.RoleModerator))
+	routes.AdminRoutes(admin, app)
+
 	// Start server with graceful shutdown
 	srv := &http.Server{
 		Addr:    "0.0.0.0:" + port,
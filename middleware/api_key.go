@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/controllers"
+	"my-work/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyHeader carries a personal API key instead of a bearer token
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyScopes maps "<method> <full path>" to the scope an API key needs for
+// that route. Routes that are not listed refuse API keys. It is filled in
+// while routes are registered and only read afterwards.
+var apiKeyScopes = map[string]string{}
+
+// AllowAPIKey lets API keys with scope call the route. path is the full
+// route path as reported by gin.Context.FullPath.
+func AllowAPIKey(method, path, scope string) {
+	apiKeyScopes[method+" "+path] = scope
+}
+
+// authenticateAPIKey resolves the principal for an X-API-Key request and
+// checks the key's scope for the matched route
+func authenticateAPIKey(ctx *gin.Context, app *config.AppConfig, rawKey string) (models.Principal, bool) {
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	scope, allowed := apiKeyScopes[ctx.Request.Method+" "+ctx.FullPath()]
+	if !allowed {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "this endpoint can't be used with an API key"})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+
+	key, err := controllers.LookupAPIKey(mctx, app, rawKey)
+	if err != nil {
+		log.Printf("API key check failed: %v", err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or revoked API key"})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+	if !key.HasScope(scope) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "API key is missing the " + scope + " scope"})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+
+	// Key principals are not cached so revocation takes effect at once
+	principal, err := controllers.LoadPrincipal(mctx, app, &models.SigningDetails{UID: key.User_ID})
+	if err != nil {
+		log.Printf("Failed to load owner %s of API key %s: %v", key.User_ID, key.ID, err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+	principal.API_Key_ID = key.ID
+	principal.API_Key_Scopes = key.Scopes
+	return principal, true
+}
@@ -11,95 +11,138 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Authentication is a Gin middleware for JWT validation
+// Authentication is a Gin middleware for JWT and API key validation
 func Authentication(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		// Set a short timeout for database operations
-		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		clientToken, tokenError := controllers.GetMyToken(ctx)
-		if tokenError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			ctx.Abort()
+		if !authenticate(ctx, app) {
 			return
 		}
-		// Validate token
-		claims, err := token.ValidateToken(clientToken, app)
-		if err != nil {
-			log.Printf("Token validation failed: %v", err)
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+
+		// Proceed to the next handler
+		ctx.Next()
+	}
+}
+
+// authenticate validates the bearer token or API key and stores the
+// principal in the context. On failure it writes the response, aborts and returns false.
+func authenticate(ctx *gin.Context, app *config.AppConfig) bool {
+	principal, ok := resolvePrincipal(ctx, app)
+	if !ok {
+		return false
+	}
+
+	// Suspended and banned users are locked out even with a valid token
+	if restriction := principal.Restriction; restriction.Active(time.Now()) {
+		ctx.JSON(http.StatusForbidden, controllers.RestrictionError(restriction))
+		ctx.Abort()
+		return false
+	}
+
+	// Set the principal and claims in context for downstream handlers
+	ctx.Set("principal", principal)
+	ctx.Set("email", principal.Email)
+	ctx.Set("uid", principal.UserID)
+	ctx.Set("sid", principal.Session_ID)
+	ctx.Set("role", principal.Role)
+	return true
+}
+
+// resolvePrincipal authenticates the request with an API key when the
+// X-API-Key header is set and with the bearer token otherwise
+func resolvePrincipal(ctx *gin.Context, app *config.AppConfig) (models.Principal, bool) {
+	if rawKey := ctx.GetHeader(APIKeyHeader); rawKey != "" {
+		return authenticateAPIKey(ctx, app, rawKey)
+	}
+
+	// Set a short timeout for database operations
+	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientToken, tokenError := controllers.GetMyToken(ctx)
+	if tokenError != "" {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+	// Validate token
+	claims, err := token.ValidateToken(clientToken, app)
+	if err != nil {
+		log.Printf("Token validation failed: %v", err)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+
+	// Challenge tokens only unlock the next sign-in step
+	if claims.Purpose != "" {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "token cannot be used for API access"})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+	// Refresh tokens are only good for /refresh
+	if claims.IsRefreshToken() {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "refresh tokens cannot be used for API access"})
+		ctx.Abort()
+		return models.Principal{}, false
+	}
+
+	// The principal is cached per session; logout, revocation and
+	// profile changes invalidate it, so a cache hit means the session was
+	// live when it was loaded
+	principal, cached := app.Principals.Get(claims.UID, claims.SID)
+	if !cached {
+		generation := app.Principals.Generation(claims.UID)
+		if _, err := token.ValidateSession(mctx, app, claims); err != nil {
+			log.Printf("Session check failed for user %s: %v", claims.UID, err)
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "session expired or revoked"})
 			ctx.Abort()
-			return
+			return models.Principal{}, false
 		}
 
-		// Optional database verification
-		if app.RequireDBCheck {
-			filter := bson.M{"user_id": claims.UID, "access_token": clientToken}
-			var user models.SetSignUpModel
-			err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, filter).Decode(&user)
-			if err != nil {
-				if err == mongo.ErrNoDocuments {
-					ctx.JSON(http.StatusUnauthorized, gin.H{"error": "token not found or user unauthorized"})
-				} else {
-					log.Printf("Database error during token check: %v", err)
-					ctx.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-				}
-				ctx.Abort()
-				return
-			}
-
-			// Check if token is revoked
-			if user.Revoked {
-				ctx.JSON(http.StatusUnauthorized, gin.H{"error": "token has been revoked"})
-				ctx.Abort()
-				return
-			}
+		principal, err = controllers.LoadPrincipal(mctx, app, claims)
+		if err != nil {
+			log.Printf("Failed to load user %s: %v", claims.UID, err)
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+			ctx.Abort()
+			return models.Principal{}, false
 		}
-
-		// Set claims in context for downstream handlers
-		ctx.Set("email", claims.Email)
-		ctx.Set("uid", claims.UID)
-
-		// Proceed to the next handler
-		ctx.Next()
+		app.Principals.Add(principal, generation)
 	}
+	return principal, true
 }
 
-// RequireAuthWithRole extends Authentication to enforce role-based access
+// RequireAuthWithRole extends Authentication to enforce role-based access.
+// The role comes from the loaded principal rather than the token, and role
+// changes invalidate the cached principal, so demotions take effect
+// immediately.
 func RequireAuthWithRole(app *config.AppConfig, requiredRole string) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		// Run basic authentication first
-		Authentication(app)(ctx)
-		if ctx.IsAborted() {
+		if !authenticate(ctx, app) {
 			return
 		}
 
-		// Example: Check role (assumes roles are stored in DB or token)
-		// Here, you'd fetch the user's role from the database or token claims
-		uid := ctx.GetString("uid")
-		mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		var user models.SetSignUpModel
-		err := app.Client.Database("talkmore").Collection("users").FindOne(mctx, bson.M{"user_id": uid}).Decode(&user)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user role"})
+		if !models.RoleAtLeast(ctx.GetString("role"), requiredRole) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions"})
 			ctx.Abort()
 			return
 		}
 
-		// Placeholder: Assume user.Role exists in your User model
-		// if user.Role != requiredRole {
-		// 	ctx.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions"})
-		// 	ctx.Abort()
-		// 	return
-		// }
+		ctx.Next()
+	}
+}
 
+// RequirePermission rejects requests whose role lacks permission. It must
+// run after Authentication or RequireAuthWithRole.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !models.HasPermission(ctx.GetString("role"), permission) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions"})
+			ctx.Abort()
+			return
+		}
 		ctx.Next()
 	}
 }
@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"my-work/config"
+	"my-work/models"
+	"my-work/principal"
+	"my-work/token"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testApp has no database, so a test fails loudly if the middleware reaches
+// for one instead of using the cached principal
+func testApp() *config.AppConfig {
+	return &config.AppConfig{
+		SecretKey:  []byte("test-secret"),
+		Principals: principal.NewCache(10, time.Minute),
+	}
+}
+
+// signIn issues a token pair for a user with role and caches their principal
+// as the middleware would after a successful session check
+func signIn(t *testing.T, app *config.AppConfig, uid, role string) models.TokenPair {
+	t.Helper()
+	pair, err := token.GenerateTokenPair(uid+"@example.com", uid, role, "", app)
+	if err != nil {
+		t.Fatalf("GenerateTokenPair: %v", err)
+	}
+	app.Principals.Add(models.Principal{
+		UserDetails: models.UserDetails{UserID: uid, Email: uid + "@example.com"},
+		Role:        role,
+		Session_ID:  pair.SessionID,
+	}, app.Principals.Generation(uid))
+	return pair
+}
+
+func serve(handler gin.HandlerFunc, bearer string) (*httptest.ResponseRecorder, bool) {
+	ran := false
+	router := gin.New()
+	router.GET("/", handler, func(ctx *gin.Context) {
+		ran = true
+		ctx.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec, ran
+}
+
+func TestRequireAuthWithRole(t *testing.T) {
+	tests := []struct {
+		role    string
+		status  int
+		reached bool
+	}{
+		{models.RoleUser, http.StatusForbidden, false},
+		{models.RoleModerator, http.StatusOK, true},
+		{models.RoleAdmin, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			app := testApp()
+			pair := signIn(t, app, "u-"+tt.role, tt.role)
+
+			rec, ran := serve(RequireAuthWithRole(app, models.RoleModerator), pair.AccessToken)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if ran != tt.reached {
+				t.Errorf("handler ran = %v, want %v", ran, tt.reached)
+			}
+		})
+	}
+}
+
+func TestRequireAuthWithRoleUsesCurrentRole(t *testing.T) {
+	app := testApp()
+	// The token still says admin but the user has since been demoted
+	pair, err := token.GenerateTokenPair("a@example.com", "demoted", models.RoleAdmin, "", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Principals.Add(models.Principal{
+		UserDetails: models.UserDetails{UserID: "demoted"},
+		Role:        models.RoleUser,
+		Session_ID:  pair.SessionID,
+	}, app.Principals.Generation("demoted"))
+
+	rec, ran := serve(RequireAuthWithRole(app, models.RoleModerator), pair.AccessToken)
+	if rec.Code != http.StatusForbidden || ran {
+		t.Errorf("status = %d, handler ran = %v; want 403 without running the handler", rec.Code, ran)
+	}
+}
+
+func TestAuthenticationRejectsRefreshToken(t *testing.T) {
+	app := testApp()
+	pair := signIn(t, app, "u1", models.RoleUser)
+
+	rec, ran := serve(Authentication(app), pair.RefreshToken)
+	if rec.Code != http.StatusUnauthorized || ran {
+		t.Errorf("status = %d, handler ran = %v; want 401 without running the handler", rec.Code, ran)
+	}
+
+	rec, ran = serve(Authentication(app), pair.AccessToken)
+	if rec.Code != http.StatusOK || !ran {
+		t.Errorf("access token: status = %d, handler ran = %v; want 200", rec.Code, ran)
+	}
+}
+
+func TestIsRefreshToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims models.SigningDetails
+		want   bool
+	}{
+		{"access", models.SigningDetails{Type: models.TokenTypeAccess}, false},
+		{"refresh", models.SigningDetails{Type: models.TokenTypeRefresh}, true},
+		{"legacy access", models.SigningDetails{}, false},
+		{"legacy refresh", models.SigningDetails{RegisteredClaims: jwt.RegisteredClaims{ID: "abc"}}, true},
+		{"challenge", models.SigningDetails{Purpose: token.PurposeTwoFactor, RegisteredClaims: jwt.RegisteredClaims{ID: "abc"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.claims.IsRefreshToken(); got != tt.want {
+			t.Errorf("%s: IsRefreshToken() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticationRejectsChallengeToken(t *testing.T) {
+	app := testApp()
+	signIn(t, app, "u1", models.RoleUser)
+	challenge, _, err := token.GenerateChallengeToken("u1", token.PurposeTwoFactor, time.Minute, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, ran := serve(Authentication(app), challenge)
+	if rec.Code != http.StatusUnauthorized || ran {
+		t.Errorf("status = %d, handler ran = %v; want 401 without running the handler", rec.Code, ran)
+	}
+}
+
+func TestAuthenticationRejectsRestrictedUser(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name        string
+		restriction *models.Restriction
+		want        int
+	}{
+		{"none", nil, http.StatusOK},
+		{"suspended", &models.Restriction{Action: models.ModerationSuspend, Until: &future}, http.StatusForbidden},
+		{"banned", &models.Restriction{Action: models.ModerationBan}, http.StatusForbidden},
+		{"suspension over", &models.Restriction{Action: models.ModerationSuspend, Until: &past}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApp()
+			pair := signIn(t, app, "u1", models.RoleUser)
+			p, _ := app.Principals.Get("u1", pair.SessionID)
+			p.Restriction = tt.restriction
+			app.Principals.Add(p, app.Principals.Generation("u1"))
+
+			rec, ran := serve(Authentication(app), pair.AccessToken)
+			if rec.Code != tt.want || ran != (tt.want == http.StatusOK) {
+				t.Errorf("status = %d, handler ran = %v; want %d", rec.Code, ran, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRefusedOnUnlistedRoute(t *testing.T) {
+	app := testApp()
+	ran := false
+	router := gin.New()
+	router.DELETE("/me", Authentication(app), func(ctx *gin.Context) {
+		ran = true
+		ctx.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodDelete, "/me", nil)
+	req.Header.Set(APIKeyHeader, "tmk_secret")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || ran {
+		t.Errorf("status = %d, handler ran = %v; want 403 without running the handler", rec.Code, ran)
+	}
+}
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// API key scopes checked per route by middleware.Authentication
+const (
+	ScopeChatRead    = "chat:read"
+	ScopeChatWrite   = "chat:write"
+	ScopeProfileRead = "profile:read"
+	ScopeAdminRead   = "admin:read"
+)
+
+// APIKeyScopePermissions lists scopes that need a role permission on top of
+// a normal account
+var APIKeyScopePermissions = map[string]string{
+	ScopeAdminRead: PermissionViewUsers,
+}
+
+// APIKey is a long-lived credential for bots and tools stored in apiKeys.
+// The key itself is "<Prefix>_<secret>"; only its SHA-256 is kept.
+type APIKey struct {
+	ID           string     `json:"id" bson:"_id"`
+	User_ID      string     `json:"user_id" bson:"user_id"`
+	Name         string     `json:"name" bson:"name"`
+	Prefix       string     `json:"prefix" bson:"prefix"`
+	Key_Hash     string     `json:"-" bson:"key_hash"`
+	Scopes       []string   `json:"scopes" bson:"scopes"`
+	Created_At   time.Time  `json:"created_at" bson:"created_at"`
+	Last_Used_At *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	Expires_At   *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Revoked      bool       `json:"revoked" bson:"revoked"`
+	Revoked_At   *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// Usable reports whether the key can still authenticate at now
+func (k *APIKey) Usable(now time.Time) bool {
+	return !k.Revoked && (k.Expires_At == nil || now.Before(*k.Expires_At))
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateAPIKey struct {
+	Name            string   `json:"name" validate:"required,max=64"`
+	Scopes          []string `json:"scopes" validate:"required,min=1,dive,oneof=chat:read chat:write profile:read admin:read"`
+	Expires_In_Days int      `json:"expires_in_days" validate:"omitempty,min=1,max=3650"`
+}
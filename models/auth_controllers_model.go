@@ -9,40 +9,83 @@ import (
 
 type GetSignUpModel struct {
 	ID         primitive.ObjectID `json:"_id" bson:"_id"`
-	OTP        int                `json:"otp" bson:"otp"`
-	Count      int                `json:"count" bson:"count"`
+	OTP_Hash   string             `json:"-" bson:"otp_hash"`
+	Failures   int                `json:"-" bson:"failures"`
+	Last_Sent  time.Time          `json:"-" bson:"last_sent_at"`
 	First_Name string             `json:"first_name" bson:"first_name" validate:"required,min=2,max=30"`
 	Last_Name  string             `json:"last_name" bson:"last_name" validate:"required,min=2,max=30"`
-	Password   string             `json:"password" bson:"password" validate:"required,min=6"`
-	Email      string             `json:"email" bson:"email" validate:"required"`
+	Password   string             `json:"password" bson:"password" validate:"required"`
+	Email      string             `json:"email" bson:"email" validate:"required_without=Phone,excluded_with=Phone,omitempty,email"`
+	Phone      string             `json:"phone,omitempty" bson:"phone,omitempty" validate:"omitempty,e164"`
 	User_ID    string             `json:"user_id" bson:"user_id"`
 	Expires_At time.Time          `json:"expires_at" bson:"expires_at"`
 }
 
 type SetSignUpModel struct {
-	ID            primitive.ObjectID `json:"_id" bson:"_id"`
-	First_Name    string             `json:"first_name" bson:"first_name"`
-	Last_Name     string             `json:"last_name" bson:"last_name"`
-	Password      string             `json:"password" bson:"password"`
-	Profile_Url   *string            `json:"profile_url" bson:"profile_url"`
-	Email         string             `json:"email" bson:"email"`
-	Access_Token  string             `json:"access_token" bson:"access_token"`
-	Refresh_Token string             `json:"refresh_token" bson:"refresh_token"`
-	Refresh_ID    time.Time          `json:"refresh_id" bson:"refresh_id"`
-	Created_At    time.Time          `json:"created_at" bson:"created_at"`
-	Updated_At    time.Time          `json:"updated_at" bson:"updated_at"`
-	User_ID       string             `json:"user_id" bson:"user_id"`
-	Location      *string            `json:"location" bson:"location"`
-	Revoked       bool               `json:"revoked" bson:"revoked"`
-	IsVarified    bool               `json:"is_varified" bson:"is_varified"`
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	First_Name  string             `json:"first_name" bson:"first_name"`
+	Last_Name   string             `json:"last_name" bson:"last_name"`
+	Password    string             `json:"password" bson:"password"`
+	Profile_Url *string            `json:"profile_url" bson:"profile_url"`
+	Email       string             `json:"email" bson:"email"`
+	Phone       string             `json:"phone,omitempty" bson:"phone,omitempty"`
+	Created_At  time.Time          `json:"created_at" bson:"created_at"`
+	Updated_At  time.Time          `json:"updated_at" bson:"updated_at"`
+	User_ID     string             `json:"user_id" bson:"user_id"`
+	Location    *string            `json:"location" bson:"location"`
+	IsVarified  bool               `json:"is_varified" bson:"is_varified"`
+	Role        string             `json:"role" bson:"role"`
+
+	TOTP_Enabled        bool     `json:"totp_enabled" bson:"totp_enabled"`
+	TOTP_Secret         string   `json:"-" bson:"totp_secret,omitempty"`
+	TOTP_Pending_Secret string   `json:"-" bson:"totp_pending_secret,omitempty"`
+	TOTP_Last_Step      int64    `json:"-" bson:"totp_last_step,omitempty"`
+	Recovery_Codes      []string `json:"-" bson:"recovery_codes,omitempty"`
+
+	OIDC_Identities []OIDCIdentity `json:"-" bson:"oidc_identities,omitempty"`
+
+	Deletion_Requested_At  *time.Time `json:"deletion_requested_at,omitempty" bson:"deletion_requested_at,omitempty"`
+	Deletion_Scheduled_For *time.Time `json:"deletion_scheduled_for,omitempty" bson:"deletion_scheduled_for,omitempty"`
+
+	Restriction *Restriction `json:"restriction,omitempty" bson:"restriction,omitempty"`
+
+	Last_Seen_At *time.Time `json:"last_seen_at,omitempty" bson:"last_seen_at,omitempty"`
+}
+
+// Password may be empty for accounts without one, see confirmIdentity
+type DeleteAccount struct {
+	Password string `json:"password"`
 }
 
 type SigningDetails struct {
 	Email string `json:"email"`
 	UID   string `json:"uid"`
+	SID   string `json:"sid,omitempty"`
+	Role  string `json:"role,omitempty"`
+	// Purpose marks single-use tokens such as 2FA challenges; it is empty
+	// on access and refresh tokens
+	Purpose string `json:"purpose,omitempty"`
+	// Type tells access and refresh tokens apart
+	Type string `json:"typ,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Token types carried in the typ claim
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+// IsRefreshToken reports whether the claims belong to a refresh token.
+// Tokens issued before the typ claim are told apart by their jti, which
+// only refresh tokens carried.
+func (c *SigningDetails) IsRefreshToken() bool {
+	if c.Type != "" {
+		return c.Type == TokenTypeRefresh
+	}
+	return c.Purpose == "" && c.ID != ""
+}
+
 type TokenVerify struct {
 	Token string `json:"token" bson:"token"`
 }
@@ -51,4 +94,49 @@ type TokenVerify struct {
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	SessionID    string `json:"-"`
+	RefreshID    string `json:"-"`
+}
+
+// PasswordResetModel is the short-lived reset OTP stored in passwordResets
+type PasswordResetModel struct {
+	User_ID    string    `json:"user_id" bson:"user_id"`
+	Email      string    `json:"email" bson:"email"`
+	OTP_Hash   string    `json:"-" bson:"otp_hash"`
+	Failures   int       `json:"-" bson:"failures"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type ForgotPassword struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPassword struct {
+	Email    string `json:"email" validate:"required,email"`
+	OTP      int    `json:"otp" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type ChangePassword struct {
+	Current_Password string `json:"current_password" validate:"required"`
+	New_Password     string `json:"new_password" validate:"required"`
+}
+
+// EmailChangeModel is a pending change of login email stored in emailChanges
+type EmailChangeModel struct {
+	User_ID    string    `json:"user_id" bson:"user_id"`
+	Old_Email  string    `json:"old_email" bson:"old_email"`
+	New_Email  string    `json:"new_email" bson:"new_email"`
+	OTP_Hash   string    `json:"-" bson:"otp_hash"`
+	Failures   int       `json:"-" bson:"failures"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type ChangeEmail struct {
+	New_Email string `json:"new_email" validate:"required,email"`
+	Password  string `json:"password"`
+}
+
+type ConfirmEmailChange struct {
+	OTP int `json:"otp" validate:"required"`
 }
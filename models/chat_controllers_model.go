@@ -5,22 +5,30 @@ import (
 )
 
 type Message struct {
-	MessageId   string    `json:"message_id" bson:"message_id"`
-	Destination string    `json:"destination" bson:"destination"`
-	Message     string    `json:"message" bson:"message"`
-	Date        time.Time `json:"date" bson:"date"`
-	Name        string    `json:"name" bson:"name"`
-	Profile     string    `json:"profile" bson:"profile"`
-	Email       string    `json:"email" bson:"email"`
+	MessageId   string     `json:"message_id" bson:"message_id"`
+	Destination string     `json:"destination" bson:"destination"`
+	Message     string     `json:"message" bson:"message"`
+	Date        time.Time  `json:"date" bson:"date"`
+	Name        string     `json:"name" bson:"name"`
+	Profile     string     `json:"profile" bson:"profile"`
+	Email       string     `json:"email" bson:"email"`
+	EditedAt    *time.Time `json:"edited_at,omitempty" bson:"-"`
+	Deleted     bool       `json:"deleted,omitempty" bson:"-"`
+}
+
+type EditMessage struct {
+	Message string `json:"message" validate:"required,max=4096"`
 }
 
 type ChatUsers struct {
-	SubId       string    `json:"sub_id" bson:"sub_id"`
-	Date        time.Time `json:"date" bson:"date"`
-	Name        string    `json:"name" bson:"name"`
-	Profile     string    `json:"profile" bson:"profile"`
-	IsUnread    bool      `json:"is_unread" bson:"is_unread"`
-	LastMessage string    `json:"last_message" bson:"last_message"`
+	SubId          string    `json:"sub_id" bson:"sub_id"`
+	ConversationID string    `json:"conversation_id" bson:"conversation_id"`
+	Date           time.Time `json:"date" bson:"date"`
+	Name           string    `json:"name" bson:"name"`
+	Profile        string    `json:"profile" bson:"profile"`
+	IsUnread       bool      `json:"is_unread" bson:"is_unread"`
+	UnreadCount    int64     `json:"unread_count" bson:"unread_count"`
+	LastMessage    string    `json:"last_message" bson:"last_message"`
 }
 
 type ChatSkipLimit struct {
@@ -33,3 +41,41 @@ type MessagesSkitLimit struct {
 	Limit int    `json:"limit" bson:"-"`
 	SubID string `json:"sub_id" bson:"sub_id"`
 }
+
+// MarkRead moves the caller's read cursor. Without Message_ID the whole
+// conversation is marked read.
+type MarkRead struct {
+	Message_ID string `json:"message_id"`
+}
+
+// ClientEvent is a non-message frame sent over the messages WebSocket, e.g.
+// {"type": "read", "conversation_id": "...", "message_id": "..."}
+type ClientEvent struct {
+	Type            string `json:"type"`
+	Conversation_ID string `json:"conversation_id"`
+	Message_ID      string `json:"message_id"`
+	Status          string `json:"status"`
+}
+
+// Frames clients send over the messages WebSocket besides chat messages
+const (
+	// ClientEventRead marks a conversation read
+	ClientEventRead = "read"
+	// ClientEventTypingStart and ClientEventTypingStop are relayed to the
+	// conversation peer as they are
+	ClientEventTypingStart = "typing_start"
+	ClientEventTypingStop  = "typing_stop"
+	// ClientEventPresence sets the connection online or away
+	ClientEventPresence = "presence"
+)
+
+// Event types pushed to the messages WebSocket
+const (
+	WebSocketEventMessage  = "message"
+	WebSocketEventSeen     = "seen"
+	WebSocketEventPresence = "presence"
+	WebSocketEventEdited   = "message_edited"
+	WebSocketEventDeleted  = "message_deleted"
+	// WebSocketEventError answers a frame that was refused
+	WebSocketEventError = "error"
+)
@@ -5,6 +5,7 @@ type UserDetails struct {
 	FirstName string `json:"first_name" bson:"first_name"`
 	LastName  string `json:"last_name" bson:"last_name"`
 	Email     string `json:"email" bson:"email"`
+	Phone     string `json:"phone,omitempty" bson:"phone,omitempty"`
 	Profile   string `json:"profile" bson:"profile"`
 }
 
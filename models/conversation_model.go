@@ -0,0 +1,90 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Conversation is the shared thread between two users in conversations.
+// _id is ConversationID of the participants, so both sides find the same
+// document.
+type Conversation struct {
+	ID              string    `json:"conversation_id" bson:"_id"`
+	Participants    []string  `json:"participants" bson:"participants"`
+	Last_Message    string    `json:"last_message" bson:"last_message"`
+	Last_Message_ID string    `json:"last_message_id" bson:"last_message_id"`
+	Last_Sender_ID  string    `json:"last_sender_id" bson:"last_sender_id"`
+	Last_Message_At time.Time `json:"last_message_at" bson:"last_message_at"`
+	Created_At      time.Time `json:"created_at" bson:"created_at"`
+	// Last_Hidden_For lists participants who deleted the last message for
+	// themselves; their chat list shows the newest message they can see
+	Last_Hidden_For []string `json:"-" bson:"last_hidden_for,omitempty"`
+	// Read_Cursors is keyed by participant user_id
+	Read_Cursors map[string]ReadCursor `json:"read_cursors,omitempty" bson:"read_cursors,omitempty"`
+}
+
+// ReadCursor is the newest message a participant has read
+type ReadCursor struct {
+	Message_ID   string    `json:"message_id" bson:"message_id"`
+	Message_Date time.Time `json:"message_date" bson:"message_date"`
+	Read_At      time.Time `json:"read_at" bson:"read_at"`
+}
+
+// ChatMessage is one message in the messages collection. Names and photos
+// are not copied in; they are looked up from users when read.
+type ChatMessage struct {
+	ID              string    `json:"message_id" bson:"_id"`
+	Conversation_ID string    `json:"conversation_id" bson:"conversation_id"`
+	Sender_ID       string    `json:"sender_id" bson:"sender_id"`
+	Recipient_ID    string    `json:"recipient_id" bson:"recipient_id"`
+	Message         string    `json:"message" bson:"message"`
+	Date            time.Time `json:"date" bson:"date"`
+
+	Edited_At    *time.Time    `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+	Edit_History []MessageEdit `json:"-" bson:"edit_history,omitempty"`
+	// Deleted_At marks a message deleted for everyone; its text is gone
+	Deleted_At *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	// Hidden_For lists participants who deleted the message for themselves
+	Hidden_For []string `json:"-" bson:"hidden_for,omitempty"`
+}
+
+// MessageEdit is a previous version of an edited message
+type MessageEdit struct {
+	Message   string    `json:"message" bson:"message"`
+	Edited_At time.Time `json:"edited_at" bson:"edited_at"`
+}
+
+// DeletedMessageText stands in for a message deleted for everyone in chat
+// lists
+const DeletedMessageText = "This message was deleted"
+
+// Scopes of DELETE /api/messages/:id
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// ConversationID returns the id of the conversation between two users. It
+// doesn't depend on the order of the arguments.
+func ConversationID(userA, userB string) string {
+	ids := []string{userA, userB}
+	sort.Strings(ids)
+	return strings.Join(ids, ":")
+}
+
+// ConversationPeer returns the other participant of a conversation id, or
+// false when uid isn't part of it
+func ConversationPeer(conversationID, uid string) (string, bool) {
+	userA, userB, ok := strings.Cut(conversationID, ":")
+	switch {
+	case !ok:
+		return "", false
+	case userA == uid:
+		return userB, true
+	case userB == uid:
+		return userA, true
+	default:
+		return "", false
+	}
+}
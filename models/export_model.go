@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Export job states
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is a user's request for a copy of their data
+type DataExport struct {
+	Export_ID      string     `json:"export_id" bson:"export_id"`
+	User_ID        string     `json:"user_id" bson:"user_id"`
+	Status         string     `json:"status" bson:"status"`
+	Error          string     `json:"error,omitempty" bson:"error,omitempty"`
+	Object_Key     string     `json:"-" bson:"object_key,omitempty"`
+	Download_Url   string     `json:"download_url,omitempty" bson:"download_url,omitempty"`
+	Url_Expires_At *time.Time `json:"url_expires_at,omitempty" bson:"url_expires_at,omitempty"`
+	Created_At     time.Time  `json:"created_at" bson:"created_at"`
+	Completed_At   *time.Time `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+	Expires_At     time.Time  `json:"-" bson:"expires_at"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// LoginAttempt counts recent failed attempts for one account or IP within a
+// scope such as sign-in. _id is "<scope>:<kind>:<subject>".
+type LoginAttempt struct {
+	Key          string    `json:"-" bson:"_id"`
+	Scope        string    `json:"scope" bson:"scope"`
+	Failures     int       `json:"failures" bson:"failures"`
+	Last_Failure time.Time `json:"last_failure" bson:"last_failure"`
+	Locked_Until time.Time `json:"locked_until" bson:"locked_until"`
+	Expires_At   time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// AccountUnlockModel is the unlock code stored in accountUnlocks. Identifier
+// is the email or phone the code was sent to.
+type AccountUnlockModel struct {
+	User_ID    string    `json:"user_id" bson:"user_id"`
+	Identifier string    `json:"identifier" bson:"identifier"`
+	OTP_Hash   string    `json:"-" bson:"otp_hash"`
+	Failures   int       `json:"-" bson:"failures"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+type RequestAccountUnlock struct {
+	Email string `json:"email" validate:"omitempty,email"`
+	Phone string `json:"phone"`
+}
+
+type UnlockAccount struct {
+	Email string `json:"email" validate:"omitempty,email"`
+	Phone string `json:"phone"`
+	OTP   int    `json:"otp" validate:"required"`
+}
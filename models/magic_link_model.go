@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// MagicLinkModel is a pending passwordless sign-in stored in magicLinks. Only
+// the keyed hash of the emailed token is kept.
+type MagicLinkModel struct {
+	Token_Hash string    `bson:"_id"`
+	User_ID    string    `bson:"user_id"`
+	Email      string    `bson:"email"`
+	IP         string    `bson:"ip"`
+	Created_At time.Time `bson:"created_at"`
+	Expires_At time.Time `bson:"expires_at"`
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type MagicLinkExchange struct {
+	Token string `json:"token" validate:"required"`
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Moderation actions recorded in moderationActions
+const (
+	ModerationSuspend = "suspend"
+	ModerationBan     = "ban"
+	ModerationLift    = "lift"
+)
+
+// Error codes returned to suspended and banned users
+const (
+	ErrorCodeAccountSuspended = "account_suspended"
+	ErrorCodeAccountBanned    = "account_banned"
+)
+
+// Restriction is the suspension or ban currently on an account. A ban has
+// no Until.
+type Restriction struct {
+	Action       string     `json:"action" bson:"action"`
+	Reason       string     `json:"reason" bson:"reason"`
+	Moderator_ID string     `json:"moderator_id" bson:"moderator_id"`
+	Created_At   time.Time  `json:"created_at" bson:"created_at"`
+	Until        *time.Time `json:"until,omitempty" bson:"until,omitempty"`
+}
+
+// Active reports whether the restriction still applies at now
+func (r *Restriction) Active(now time.Time) bool {
+	if r == nil {
+		return false
+	}
+	return r.Until == nil || now.Before(*r.Until)
+}
+
+// ErrorCode is the machine-readable code sent to the restricted user
+func (r *Restriction) ErrorCode() string {
+	if r.Action == ModerationBan {
+		return ErrorCodeAccountBanned
+	}
+	return ErrorCodeAccountSuspended
+}
+
+// ModerationAction is one entry of an account's moderation history
+type ModerationAction struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	User_ID      string             `json:"user_id" bson:"user_id"`
+	Action       string             `json:"action" bson:"action"`
+	Reason       string             `json:"reason" bson:"reason"`
+	Moderator_ID string             `json:"moderator_id" bson:"moderator_id"`
+	Created_At   time.Time          `json:"created_at" bson:"created_at"`
+	Until        *time.Time         `json:"until,omitempty" bson:"until,omitempty"`
+}
+
+type SuspendUser struct {
+	Reason string    `json:"reason" validate:"required,max=500"`
+	Until  time.Time `json:"until" validate:"required"`
+}
+
+type BanUser struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type LiftRestriction struct {
+	Reason string `json:"reason" validate:"max=500"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// OIDCIdentity links a users row to an account at an OIDC provider
+type OIDCIdentity struct {
+	Provider  string    `json:"provider" bson:"provider"`
+	Subject   string    `json:"subject" bson:"subject"`
+	Linked_At time.Time `json:"linked_at" bson:"linked_at"`
+}
+
+// OIDCState is the pending login stored between redirect and callback.
+// Binding ties it to the browser or app that started the login.
+type OIDCState struct {
+	State      string    `bson:"state"`
+	Provider   string    `bson:"provider"`
+	Nonce      string    `bson:"nonce"`
+	Verifier   string    `bson:"verifier"`
+	Binding    string    `bson:"binding"`
+	Expires_At time.Time `bson:"expires_at"`
+}
+
+// OIDCCallback is the JSON callback body; apps echo the binding they got
+// from the login instead of relying on the cookie
+type OIDCCallback struct {
+	Code    string `json:"code" form:"code"`
+	State   string `json:"state" form:"state"`
+	Binding string `json:"binding"`
+}
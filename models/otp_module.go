@@ -1,6 +1,21 @@
 package models
 
+import "time"
+
 type ValidateOTP struct {
 	OTP int    `json:"otp" bson:"otp"`
 	ID  string `json:"_id" bson:"_id"`
 }
+
+type ResendOTP struct {
+	ID string `json:"_id" bson:"_id" validate:"required"`
+}
+
+// OTPSend records one OTP sent to an email address or phone number so
+// cooldowns and daily caps can be enforced
+type OTPSend struct {
+	Recipient  string    `bson:"recipient"`
+	IP         string    `bson:"ip"`
+	Sent_At    time.Time `bson:"sent_at"`
+	Expires_At time.Time `bson:"expires_at"`
+}
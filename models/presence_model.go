@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Presence statuses
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Presence is a user's status as shown to their chat peers
+type Presence struct {
+	User_ID   string     `json:"user_id"`
+	Status    string     `json:"status"`
+	Last_Seen *time.Time `json:"last_seen,omitempty"`
+}
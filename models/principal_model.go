@@ -0,0 +1,28 @@
+package models
+
+// Principal is the authenticated caller. middleware.Authentication resolves
+// it once per request and handlers read it with controllers.CurrentPrincipal.
+// API key callers have API_Key_ID and API_Key_Scopes set instead of
+// Session_ID.
+type Principal struct {
+	UserDetails
+	Role           string       `json:"role"`
+	Session_ID     string       `json:"session_id"`
+	API_Key_ID     string       `json:"api_key_id,omitempty"`
+	API_Key_Scopes []string     `json:"-"`
+	Restriction    *Restriction `json:"-"`
+}
+
+// HasScope reports whether the caller may act within scope. Sessions are
+// not limited by scopes; API keys only get the scopes they were created with.
+func (p *Principal) HasScope(scope string) bool {
+	if p.API_Key_ID == "" {
+		return true
+	}
+	for _, s := range p.API_Key_Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
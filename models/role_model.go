@@ -0,0 +1,71 @@
+package models
+
+// Roles, lowest to highest
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permissions checked by middleware.RequirePermission
+const (
+	PermissionViewUsers   = "users:read"
+	PermissionModerate    = "users:moderate"
+	PermissionManageRoles = "users:roles"
+)
+
+var roleRank = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// RolePermissions lists what each role may do on top of normal user access
+var RolePermissions = map[string][]string{
+	RoleUser:      {},
+	RoleModerator: {PermissionViewUsers, PermissionModerate},
+	RoleAdmin:     {PermissionViewUsers, PermissionModerate, PermissionManageRoles},
+}
+
+// NormalizeRole treats accounts created before roles existed as plain users
+func NormalizeRole(role string) string {
+	if role == "" {
+		return RoleUser
+	}
+	return role
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role ranks at or above required
+func RoleAtLeast(role, required string) bool {
+	return roleRank[NormalizeRole(role)] >= roleRank[required]
+}
+
+func HasPermission(role, permission string) bool {
+	for _, p := range RolePermissions[NormalizeRole(role)] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type SetRole struct {
+	Role string `json:"role" validate:"required,oneof=user moderator admin"`
+}
+
+// AdminUserView is what moderators see about an account
+type AdminUserView struct {
+	UserID       string `json:"user_id" bson:"user_id"`
+	FirstName    string `json:"first_name" bson:"first_name"`
+	LastName     string `json:"last_name" bson:"last_name"`
+	Email        string `json:"email" bson:"email"`
+	Role         string `json:"role" bson:"role"`
+	TOTP_Enabled bool   `json:"totp_enabled" bson:"totp_enabled"`
+
+	Restriction *Restriction `json:"restriction,omitempty" bson:"restriction,omitempty"`
+}
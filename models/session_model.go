@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// Session is one signed-in device. The ID is the jti of the first refresh
+// token issued to the device; Refresh_ID tracks the jti currently in use.
+type Session struct {
+	ID             string    `json:"session_id" bson:"_id"`
+	User_ID        string    `json:"user_id" bson:"user_id"`
+	Refresh_ID     string    `json:"-" bson:"refresh_id"`
+	Device_Name    string    `json:"device_name" bson:"device_name"`
+	IP             string    `json:"ip" bson:"ip"`
+	User_Agent     string    `json:"user_agent" bson:"user_agent"`
+	Created_At     time.Time `json:"created_at" bson:"created_at"`
+	Last_Used_At   time.Time `json:"last_used_at" bson:"last_used_at"`
+	Expires_At     time.Time `json:"expires_at" bson:"expires_at"`
+	Revoked        bool      `json:"-" bson:"revoked"`
+	Revoked_Reason string    `json:"-" bson:"revoked_reason,omitempty"`
+	Current        bool      `json:"current" bson:"-"`
+}
+
+// SessionMeta describes the device a session is being opened from
+type SessionMeta struct {
+	DeviceName string
+	IP         string
+	UserAgent  string
+}
+
+// RefreshTokenRecord tracks one issued refresh token. Every token issued to
+// a session shares the session ID as its Family_ID.
+type RefreshTokenRecord struct {
+	ID          string     `json:"jti" bson:"_id"`
+	Family_ID   string     `json:"family_id" bson:"family_id"`
+	User_ID     string     `json:"user_id" bson:"user_id"`
+	Consumed    bool       `json:"consumed" bson:"consumed"`
+	Consumed_At *time.Time `json:"consumed_at" bson:"consumed_at"`
+	Issued_At   time.Time  `json:"issued_at" bson:"issued_at"`
+	Expires_At  time.Time  `json:"expires_at" bson:"expires_at"`
+}
+
+// Security event types recorded in securityEvents
+const (
+	SecurityEventRefreshReuse  = "refresh_token_reuse"
+	SecurityEventAccountLocked = "account_locked"
+)
+
+// SecurityEvent is an audit record of something suspicious on an account
+type SecurityEvent struct {
+	User_ID    string    `json:"user_id" bson:"user_id"`
+	Type       string    `json:"type" bson:"type"`
+	Session_ID string    `json:"session_id,omitempty" bson:"session_id,omitempty"`
+	IP         string    `json:"ip,omitempty" bson:"ip,omitempty"`
+	User_Agent string    `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	Details    string    `json:"details" bson:"details"`
+	Created_At time.Time `json:"created_at" bson:"created_at"`
+}
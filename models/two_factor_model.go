@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+type TwoFactorCode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TwoFactorDisable struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// TwoFactorSignIn exchanges a SignIn challenge for a token pair using either
+// a TOTP code or one of the recovery codes
+type TwoFactorSignIn struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// TwoFactorChallenge is an outstanding 2FA challenge stored in
+// twoFactorChallenges, keyed by the challenge token's jti. It is deleted
+// when used or after too many wrong codes, so each token works once.
+type TwoFactorChallenge struct {
+	ID         string    `json:"id" bson:"_id"`
+	User_ID    string    `json:"user_id" bson:"user_id"`
+	Failures   int       `json:"failures" bson:"failures"`
+	Expires_At time.Time `json:"expires_at" bson:"expires_at"`
+}
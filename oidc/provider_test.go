@@ -0,0 +1,239 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testClientID = "talkmore-test"
+	testCode     = "auth-code"
+	testKid      = "test-key"
+)
+
+// mockIssuer is a local OpenID provider with discovery, JWKS and a token
+// endpoint that enforces PKCE
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+	// claims tweaks the ID token before it is signed
+	claims func(*IDTokenClaims)
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: testKid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize plays the user approving the sign-in: it records the PKCE
+// challenge and nonce from the authorization URL
+func (m *mockIssuer) authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, m.URL+"/authorize?") {
+		t.Fatalf("authorization URL %s does not point at the issuer", authURL)
+	}
+	q := u.Query()
+	m.mu.Lock()
+	m.challenge, m.nonce = q.Get("code_challenge"), q.Get("nonce")
+	m.mu.Unlock()
+	return q
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	challenge, nonce, tweak := m.challenge, m.nonce, m.claims
+	m.mu.Unlock()
+
+	if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != testCode {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	if CodeChallenge(r.Form.Get("code_verifier")) != challenge {
+		http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		GivenName:     "Ada",
+		FamilyName:    "Lovelace",
+		Nonce:         nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.URL,
+			Subject:   "subject-1",
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	if tweak != nil {
+		tweak(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testKid
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(TokenResponse{AccessToken: "at", IDToken: signed, TokenType: "Bearer", ExpiresIn: 60})
+}
+
+func (m *mockIssuer) provider() *Provider {
+	p := NewProvider(Config{
+		Name:        "mock",
+		Issuer:      m.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/oidc/mock/callback",
+	})
+	p.HTTPClient = m.Client()
+	return p
+}
+
+// signIn runs the flow up to the ID token and returns the verified claims
+func signIn(t *testing.T, m *mockIssuer, p *Provider, verifier string) (*IDTokenClaims, error) {
+	t.Helper()
+	ctx := context.Background()
+	state, nonce, realVerifier := "state-1", "nonce-1", "verifier-with-enough-entropy-0123456789"
+	authURL, err := p.AuthCodeURL(ctx, state, nonce, realVerifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	q := m.authorize(t, authURL)
+	if q.Get("state") != state || q.Get("code_challenge_method") != "S256" || q.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization parameters: %v", q)
+	}
+	if q.Get("code_challenge") != CodeChallenge(realVerifier) {
+		t.Fatalf("code_challenge is not the S256 of the verifier")
+	}
+
+	if verifier == "" {
+		verifier = realVerifier
+	}
+	tokens, err := p.Exchange(ctx, testCode, verifier)
+	if err != nil {
+		return nil, err
+	}
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+func TestFlowAgainstMockIssuer(t *testing.T) {
+	m := newMockIssuer(t)
+	claims, err := signIn(t, m, m.provider(), "")
+	if err != nil {
+		t.Fatalf("sign-in failed: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "ada@example.com" || !bool(claims.EmailVerified) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	m := newMockIssuer(t)
+	if _, err := signIn(t, m, m.provider(), "someone-elses-verifier"); err == nil {
+		t.Fatal("exchange with the wrong PKCE verifier succeeded")
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		tweak func(*IDTokenClaims)
+	}{
+		{"wrong nonce", func(c *IDTokenClaims) { c.Nonce = "other" }},
+		{"wrong audience", func(c *IDTokenClaims) { c.Audience = jwt.ClaimStrings{"other-client"} }},
+		{"wrong issuer", func(c *IDTokenClaims) { c.Issuer = "https://evil.example.com" }},
+		{"expired", func(c *IDTokenClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }},
+		{"no subject", func(c *IDTokenClaims) { c.Subject = "" }},
+		{"foreign azp", func(c *IDTokenClaims) {
+			c.Audience = jwt.ClaimStrings{testClientID, "other-client"}
+			c.AuthorizedBy = "other-client"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockIssuer(t)
+			m.claims = tt.tweak
+			if _, err := signIn(t, m, m.provider(), ""); err == nil {
+				t.Fatal("ID token accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsForeignKey(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+	// Sign with a key the issuer never published
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.key = other
+	if _, err := signIn(t, m, p, ""); err == nil {
+		t.Fatal("ID token signed by an unpublished key accepted")
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+	// The document is still fetched, but names m.URL rather than this
+	p.Issuer = m.URL + "/"
+	if _, err := p.Discover(context.Background()); err == nil {
+		t.Fatal("discovery accepted a document for another issuer")
+	}
+}
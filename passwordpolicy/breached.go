@@ -0,0 +1,78 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachedList looks passwords up in a local copy of the Have I Been Pwned
+// range files: one file per 5 character SHA-1 prefix (named "ABCDE" or
+// "ABCDE.txt") holding "SUFFIX:COUNT" lines, as served by the range API.
+type BreachedList struct {
+	Dir string
+	// MinCount ignores hashes seen fewer times than this in breaches
+	MinCount int
+}
+
+// NewBreachedList checks that dir exists and returns a list backed by it
+func NewBreachedList(dir string, minCount int) (*BreachedList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("breached password list: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached password list: %s is not a directory", dir)
+	}
+	if minCount < 1 {
+		minCount = 1
+	}
+	return &BreachedList{Dir: dir, MinCount: minCount}, nil
+}
+
+// Contains reports whether the password's SHA-1 is in the list
+func (b *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := b.open(prefix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// No file for the prefix means no breached hash starts with it
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineSuffix, count, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			// Lists without counts only hold breached hashes
+			return true, nil
+		}
+		return n >= b.MinCount, nil
+	}
+	return false, scanner.Err()
+}
+
+func (b *BreachedList) open(prefix string) (*os.File, error) {
+	f, err := os.Open(filepath.Join(b.Dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(b.Dir, prefix+".txt"))
+	}
+	return f, err
+}
@@ -0,0 +1,132 @@
+// Package passwordpolicy checks new passwords against configurable rules and
+// an offline list of breached passwords.
+package passwordpolicy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Violation codes returned by Check
+const (
+	CodeTooShort        = "too_short"
+	CodeTooLong         = "too_long"
+	CodeMissingUpper    = "missing_uppercase"
+	CodeMissingLower    = "missing_lowercase"
+	CodeMissingDigit    = "missing_digit"
+	CodeMissingSymbol   = "missing_symbol"
+	CodePersonalInfo    = "contains_personal_info"
+	CodeBreached        = "breached"
+	CodeBreachCheckFail = "breach_check_failed"
+)
+
+// maxBcryptBytes is the longest password bcrypt can hash
+const maxBcryptBytes = 72
+
+// minPersonalLength is the shortest name or email part that counts as
+// personal information; shorter parts match too many passwords by chance
+const minPersonalLength = 3
+
+// Violation is one rule a password breaks
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Policy is the set of rules a new password must pass. Breached may be nil
+// to skip the breached-password check.
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// DisallowPersonal rejects passwords containing the user's name or
+	// email
+	DisallowPersonal bool
+	Breached         *BreachedList
+}
+
+// Check returns every rule the password breaks; none means it's accepted.
+// personal holds the user's names, email and phone.
+func (p *Policy) Check(password string, personal ...string) []Violation {
+	var violations []Violation
+	add := func(code, format string, args ...interface{}) {
+		violations = append(violations, Violation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add(CodeTooShort, "must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(CodeTooLong, "must be at most %d characters", p.MaxLength)
+	} else if len(password) > maxBcryptBytes {
+		add(CodeTooLong, "must be at most %d bytes", maxBcryptBytes)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		add(CodeMissingUpper, "must contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		add(CodeMissingLower, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		add(CodeMissingDigit, "must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		add(CodeMissingSymbol, "must contain a symbol")
+	}
+
+	if p.DisallowPersonal && containsPersonal(password, personal) {
+		add(CodePersonalInfo, "must not contain your name, email or phone number")
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		switch {
+		case err != nil:
+			add(CodeBreachCheckFail, "could not be checked against known breaches, try again later")
+		case breached:
+			add(CodeBreached, "has appeared in a data breach, choose a different one")
+		}
+	}
+	return violations
+}
+
+// containsPersonal reports whether the password contains any of the values,
+// or the local part of an email, ignoring case
+func containsPersonal(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		parts := []string{value}
+		if at := strings.IndexByte(value, '@'); at > 0 {
+			parts = append(parts, value[:at])
+		}
+		parts = append(parts, strings.Fields(value)...)
+		for _, part := range parts {
+			part = strings.TrimPrefix(part, "+")
+			if utf8.RuneCountInString(part) >= minPersonalLength && strings.Contains(lower, part) {
+				return true
+			}
+		}
+	}
+	return false
+}
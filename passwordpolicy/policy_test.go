@@ -0,0 +1,136 @@
+package passwordpolicy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func codes(violations []Violation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, v.Code)
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	strict := &Policy{
+		MinLength:        10,
+		MaxLength:        64,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowPersonal: true,
+	}
+	personal := []string{"Ada", "Lovelace", "ada.king@example.com", "+14155550100"}
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		password string
+		want     []string
+	}{
+		{"accepted", strict, "Tr0ub4dor&3x", nil},
+		{"too short", strict, "Aa1!", []string{CodeTooShort}},
+		{"too long", strict, "Aa1!" + strings.Repeat("x", 61), []string{CodeTooLong}},
+		{"no upper", strict, "tr0ub4dor&3x", []string{CodeMissingUpper}},
+		{"no lower", strict, "TR0UB4DOR&3X", []string{CodeMissingLower}},
+		{"no digit", strict, "Troubador&xx", []string{CodeMissingDigit}},
+		{"no symbol", strict, "Tr0ub4dor3xx", []string{CodeMissingSymbol}},
+		{"space counts as symbol", strict, "Tr0ub4dor 3x", nil},
+		{"unicode letters", strict, "Ünïcödé1!xyz", nil},
+		{"everything missing", strict, "", []string{CodeTooShort, CodeMissingUpper, CodeMissingLower, CodeMissingDigit, CodeMissingSymbol}},
+		{"first name", strict, "xxADA!2024yy", []string{CodePersonalInfo}},
+		{"last name", strict, "lovelace#2024X", []string{CodePersonalInfo}},
+		{"email local part", strict, "Ada.King#2024", []string{CodePersonalInfo}},
+		{"phone without plus", strict, "X!14155550100x", []string{CodePersonalInfo}},
+		{"personal allowed", &Policy{MinLength: 8}, "lovelace2024", nil},
+		// Counted in characters, not bytes
+		{"multibyte length", &Policy{MinLength: 4}, "äöü", []string{CodeTooShort}},
+		// Without MaxLength bcrypt's 72 byte limit still applies
+		{"bcrypt limit", &Policy{MinLength: 8}, strings.Repeat("é", 37), []string{CodeTooLong}},
+		{"bcrypt limit exact", &Policy{MinLength: 8}, strings.Repeat("é", 36), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := codes(tt.policy.Check(tt.password, personal...))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainsPersonalIgnoresShortParts(t *testing.T) {
+	// "Li" is below minPersonalLength and would match far too much
+	if containsPersonal("Alibaba#2024", []string{"Li", "Wu"}) {
+		t.Error("two letter name treated as personal information")
+	}
+}
+
+// writeRange writes a range file holding the given passwords' suffixes
+func writeRange(t *testing.T, dir, name string, counts map[string]string) {
+	t.Helper()
+	var lines []string
+	for password, count := range counts {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		line := hash[5:]
+		if count != "" {
+			line += ":" + count
+		}
+		lines = append(lines, line)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func prefix(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))[:5]
+}
+
+func TestBreachedList(t *testing.T) {
+	dir := t.TempDir()
+	writeRange(t, dir, prefix("password"), map[string]string{"password": "9545824"})
+	writeRange(t, dir, prefix("rarely-seen")+".txt", map[string]string{"rarely-seen": "2"})
+	writeRange(t, dir, prefix("no-count"), map[string]string{"no-count": ""})
+
+	list, err := NewBreachedList(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"rarely-seen", false},
+		{"no-count", true},
+		{"Tr0ub4dor&3x", false},
+	}
+	for _, tt := range tests {
+		got, err := list.Contains(tt.password)
+		if err != nil || got != tt.want {
+			t.Errorf("Contains(%q) = %v, %v; want %v", tt.password, got, err, tt.want)
+		}
+	}
+
+	policy := &Policy{MinLength: 8, Breached: list}
+	if got := codes(policy.Check("password")); !reflect.DeepEqual(got, []string{CodeBreached}) {
+		t.Errorf("Check(breached) = %v", got)
+	}
+}
+
+func TestNewBreachedListRejectsMissingDir(t *testing.T) {
+	if _, err := NewBreachedList(filepath.Join(t.TempDir(), "missing"), 1); err == nil {
+		t.Error("missing directory accepted")
+	}
+}
@@ -0,0 +1,85 @@
+// Package presence tracks which users have live chat connections and
+// whether they are active or away.
+package presence
+
+import (
+	"my-work/models"
+	"sync"
+	"time"
+)
+
+// Tracker holds the presence of users connected to this instance. Each
+// connection reports its own away state; a user is online while any of
+// their connections is active. Users without connections are offline and
+// their last seen time is kept by the caller.
+type Tracker struct {
+	mu    sync.Mutex
+	conns map[string]map[interface{}]bool // user_id → connection → away
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{conns: map[string]map[interface{}]bool{}}
+}
+
+// Connect registers a new active connection. It returns the user's presence
+// and whether the status changed.
+func (t *Tracker) Connect(uid string, conn interface{}) (models.Presence, bool) {
+	return t.update(uid, func() {
+		if t.conns[uid] == nil {
+			t.conns[uid] = map[interface{}]bool{}
+		}
+		t.conns[uid][conn] = false
+	})
+}
+
+// SetAway marks one connection away or active again
+func (t *Tracker) SetAway(uid string, conn interface{}, away bool) (models.Presence, bool) {
+	return t.update(uid, func() {
+		if _, ok := t.conns[uid][conn]; ok {
+			t.conns[uid][conn] = away
+		}
+	})
+}
+
+// Disconnect removes a connection. The user goes offline, last seen now,
+// with their last connection.
+func (t *Tracker) Disconnect(uid string, conn interface{}) (models.Presence, bool) {
+	return t.update(uid, func() {
+		delete(t.conns[uid], conn)
+		if len(t.conns[uid]) == 0 {
+			delete(t.conns, uid)
+		}
+	})
+}
+
+// Get returns the presence of a connected user. ok is false for users who
+// are offline.
+func (t *Tracker) Get(uid string) (models.Presence, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.presence(uid)
+	return p, p.Status != models.PresenceOffline
+}
+
+func (t *Tracker) update(uid string, change func()) (models.Presence, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	before := t.presence(uid).Status
+	change()
+	after := t.presence(uid)
+	return after, after.Status != before
+}
+
+func (t *Tracker) presence(uid string) models.Presence {
+	now := time.Now().UTC()
+	p := models.Presence{User_ID: uid, Status: models.PresenceOffline, Last_Seen: &now}
+	for _, away := range t.conns[uid] {
+		p.Status = models.PresenceAway
+		if !away {
+			p.Status = models.PresenceOnline
+			break
+		}
+	}
+	return p
+}
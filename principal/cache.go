@@ -0,0 +1,200 @@
+// Package principal caches the authenticated caller so the auth middleware
+// doesn't have to load the user from MongoDB on every request.
+package principal
+
+import (
+	"container/list"
+	"hash/fnv"
+	"my-work/models"
+	"sync"
+	"time"
+)
+
+// Cache is a size-bounded LRU of principals keyed by user and session.
+// Entries expire after the TTL. Invalidations are passed to the OnInvalidate
+// hook so other instances can Apply them; should one get lost, the TTL still
+// bounds how long stale data is served.
+//
+// A principal is loaded outside the lock, so an invalidation can land
+// between the load and Add. Callers read Generation before loading and pass
+// it to Add, which then skips caching what may be stale.
+type Cache struct {
+	mu           sync.Mutex
+	ttl          time.Duration
+	size         int
+	order        *list.List
+	entries      map[string]*list.Element
+	byUser       map[string]map[string]struct{}
+	onInvalidate func(Invalidation)
+	// generations counts invalidations per stripe of user IDs; a shared
+	// stripe only costs the other user a cache miss
+	generations [generationStripes]uint64
+}
+
+const generationStripes = 256
+
+// Invalidation names a dropped session, or every session of the user when
+// Session_ID is empty
+type Invalidation struct {
+	User_ID    string `json:"user_id"`
+	Session_ID string `json:"session_id,omitempty"`
+}
+
+type entry struct {
+	key       string
+	uid       string
+	principal models.Principal
+	expiresAt time.Time
+}
+
+// NewCache returns a cache holding at most size principals for ttl each. A
+// size or ttl of zero disables caching.
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		byUser:  map[string]map[string]struct{}{},
+	}
+}
+
+func cacheKey(uid, sid string) string {
+	return uid + "\x00" + sid
+}
+
+// Get returns the cached principal for the user's session
+func (c *Cache) Get(uid, sid string) (models.Principal, bool) {
+	if c == nil {
+		return models.Principal{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey(uid, sid)]
+	if !ok {
+		return models.Principal{}, false
+	}
+	e := elem.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		c.remove(elem)
+		return models.Principal{}, false
+	}
+	c.order.MoveToFront(elem)
+	return e.principal, true
+}
+
+func stripe(uid string) int {
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+	return int(h.Sum32() % generationStripes)
+}
+
+// Generation returns the user's invalidation count, to be read before
+// loading their principal and passed to Add
+func (c *Cache) Generation(uid string) uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[stripe(uid)]
+}
+
+// Add caches p, evicting the least recently used entry when full. It caches
+// nothing if the user was invalidated since generation was read.
+func (c *Cache) Add(p models.Principal, generation uint64) {
+	if c == nil || c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[stripe(p.UserID)] != generation {
+		return
+	}
+
+	key := cacheKey(p.UserID, p.Session_ID)
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	elem := c.order.PushFront(&entry{
+		key:       key,
+		uid:       p.UserID,
+		principal: p,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+	c.entries[key] = elem
+	if c.byUser[p.UserID] == nil {
+		c.byUser[p.UserID] = map[string]struct{}{}
+	}
+	c.byUser[p.UserID][key] = struct{}{}
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// InvalidateSession drops one session, e.g. on logout
+func (c *Cache) InvalidateSession(uid, sid string) {
+	c.invalidate(Invalidation{User_ID: uid, Session_ID: sid})
+}
+
+// InvalidateUser drops every session of the user, e.g. after a profile or
+// role change or when all sessions are revoked
+func (c *Cache) InvalidateUser(uid string) {
+	c.invalidate(Invalidation{User_ID: uid})
+}
+
+// OnInvalidate sets fn to receive every InvalidateSession and InvalidateUser
+// so it can pass them on to other instances. Set it before serving.
+func (c *Cache) OnInvalidate(fn func(Invalidation)) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onInvalidate = fn
+}
+
+// Apply drops what another instance invalidated without passing it on
+func (c *Cache) Apply(inv Invalidation) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[stripe(inv.User_ID)]++
+	if inv.Session_ID != "" {
+		if elem, ok := c.entries[cacheKey(inv.User_ID, inv.Session_ID)]; ok {
+			c.remove(elem)
+		}
+		return
+	}
+	for key := range c.byUser[inv.User_ID] {
+		c.remove(c.entries[key])
+	}
+}
+
+func (c *Cache) invalidate(inv Invalidation) {
+	if c == nil {
+		return
+	}
+	c.Apply(inv)
+	c.mu.Lock()
+	fn := c.onInvalidate
+	c.mu.Unlock()
+	if fn != nil {
+		fn(inv)
+	}
+}
+
+// remove must be called with mu held
+func (c *Cache) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	c.order.Remove(elem)
+	delete(c.entries, e.key)
+	delete(c.byUser[e.uid], e.key)
+	if len(c.byUser[e.uid]) == 0 {
+		delete(c.byUser, e.uid)
+	}
+}
@@ -0,0 +1,106 @@
+package principal
+
+import (
+	"my-work/models"
+	"testing"
+	"time"
+)
+
+func principalFor(uid, sid string) models.Principal {
+	return models.Principal{UserDetails: models.UserDetails{UserID: uid}, Session_ID: sid}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(c *Cache)
+		want       Invalidation
+		gone       []string
+		kept       []string
+	}{
+		{
+			name:       "session",
+			invalidate: func(c *Cache) { c.InvalidateSession("u1", "s1") },
+			want:       Invalidation{User_ID: "u1", Session_ID: "s1"},
+			gone:       []string{"s1"},
+			kept:       []string{"s2"},
+		},
+		{
+			name:       "user",
+			invalidate: func(c *Cache) { c.InvalidateUser("u1") },
+			want:       Invalidation{User_ID: "u1"},
+			gone:       []string{"s1", "s2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := NewCache(10, time.Minute), NewCache(10, time.Minute)
+			for _, c := range []*Cache{local, remote} {
+				for _, p := range []models.Principal{principalFor("u1", "s1"), principalFor("u1", "s2"), principalFor("u2", "s3")} {
+					c.Add(p, c.Generation(p.UserID))
+				}
+			}
+			// Stand-in for the broadcast to other instances
+			var sent []Invalidation
+			local.OnInvalidate(func(inv Invalidation) {
+				sent = append(sent, inv)
+				remote.Apply(inv)
+			})
+
+			tt.invalidate(local)
+			if len(sent) != 1 || sent[0] != tt.want {
+				t.Fatalf("broadcast %+v, want [%+v]", sent, tt.want)
+			}
+			for _, c := range []*Cache{local, remote} {
+				for _, sid := range tt.gone {
+					if _, ok := c.Get("u1", sid); ok {
+						t.Errorf("session %s still cached", sid)
+					}
+				}
+				for _, sid := range tt.kept {
+					if _, ok := c.Get("u1", sid); !ok {
+						t.Errorf("session %s dropped", sid)
+					}
+				}
+				if _, ok := c.Get("u2", "s3"); !ok {
+					t.Error("another user's session dropped")
+				}
+			}
+		})
+	}
+}
+
+func TestAddAfterInvalidationIsDropped(t *testing.T) {
+	for _, inv := range []Invalidation{{User_ID: "u1"}, {User_ID: "u1", Session_ID: "s1"}} {
+		c := NewCache(10, time.Minute)
+		// Read before the session check; the invalidation lands while the
+		// principal is being loaded
+		generation := c.Generation("u1")
+		c.Apply(inv)
+		c.Add(principalFor("u1", "s1"), generation)
+		if _, ok := c.Get("u1", "s1"); ok {
+			t.Errorf("principal loaded before %+v was cached", inv)
+		}
+
+		c.Add(principalFor("u1", "s1"), c.Generation("u1"))
+		if _, ok := c.Get("u1", "s1"); !ok {
+			t.Errorf("principal loaded after %+v was not cached", inv)
+		}
+	}
+}
+
+func TestApplyDoesNotRebroadcast(t *testing.T) {
+	c := NewCache(10, time.Minute)
+	c.OnInvalidate(func(Invalidation) { t.Error("Apply passed the invalidation on") })
+	c.Apply(Invalidation{User_ID: "u1"})
+}
+
+func TestNilCache(t *testing.T) {
+	var c *Cache
+	c.Add(principalFor("u1", ""), c.Generation("u1"))
+	c.InvalidateUser("u1")
+	c.Apply(Invalidation{User_ID: "u1"})
+	if _, ok := c.Get("u1", ""); ok {
+		t.Error("nil cache returned a principal")
+	}
+}
@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"my-work/models"
+	"sync"
+)
+
+// Memory delivers messages within this process only. It suits a single
+// instance and tests.
+type Memory struct {
+	mu         sync.RWMutex
+	handler    Handler
+	subscribed map[string]int
+	presence   map[string]models.Presence
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subscribed: map[string]int{},
+		presence:   map[string]models.Presence{},
+	}
+}
+
+func (m *Memory) Start(handler Handler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handler != nil {
+		return errors.New("pubsub: already started")
+	}
+	m.handler = handler
+	return nil
+}
+
+// Publish hands the message straight to the handler when the user is
+// subscribed or the message is for AllInstances
+func (m *Memory) Publish(ctx context.Context, msg Message) error {
+	m.mu.RLock()
+	handler := m.handler
+	subscribed := wanted(m.subscribed, msg.User_ID)
+	m.mu.RUnlock()
+
+	if handler != nil && subscribed {
+		handler(msg)
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribed[userID]++
+}
+
+func (m *Memory) Unsubscribe(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscribed[userID]--; m.subscribed[userID] <= 0 {
+		delete(m.subscribed, userID)
+	}
+}
+
+func (m *Memory) RegisterPresence(ctx context.Context, p models.Presence) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.Status == models.PresenceOffline {
+		delete(m.presence, p.User_ID)
+	} else {
+		m.presence[p.User_ID] = p
+	}
+	return nil
+}
+
+func (m *Memory) Presence(ctx context.Context, userID string) (models.Presence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var seen []models.Presence
+	if p, ok := m.presence[userID]; ok {
+		seen = append(seen, p)
+	}
+	return mergePresence(userID, seen), nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,331 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"my-work/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// presenceTTL is how long an instance's presence entries outlive its
+	// last heartbeat, e.g. after a crash
+	presenceTTL       = 2 * time.Minute
+	presenceHeartbeat = 30 * time.Second
+	// retryDelay spaces out attempts to reopen the tailable cursor
+	retryDelay = time.Second
+	// resumeWindow is how far before the last event a reopened cursor starts
+	// looking for it, and so how much clock skew between instances is covered
+	resumeWindow = 10 * time.Minute
+)
+
+// mongoEvent is a Message stored in the capped events collection
+type mongoEvent struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Origin     string             `bson:"origin"`
+	Message    `bson:",inline"`
+	Created_At time.Time `bson:"created_at"`
+}
+
+// mongoPresence is one instance's view of a user in the presence collection
+type mongoPresence struct {
+	ID         string     `bson:"_id"`
+	User_ID    string     `bson:"user_id"`
+	Instance   string     `bson:"instance"`
+	Status     string     `bson:"status"`
+	Last_Seen  *time.Time `bson:"last_seen,omitempty"`
+	Expires_At time.Time  `bson:"expires_at"`
+}
+
+// Mongo shares messages between instances through a capped collection that
+// every instance follows with a tailable cursor, so no broker is needed.
+// Messages for users connected to the publishing instance are delivered
+// locally right away; the others pick them up from the collection.
+//
+// ObjectIDs from different instances are only roughly ordered, so a reopened
+// cursor resumes by insertion order: it reads from resumeWindow before the
+// last event and skips everything up to that event.
+type Mongo struct {
+	events   *mongo.Collection
+	presence *mongo.Collection
+	instance string
+
+	mu         sync.RWMutex
+	handler    Handler
+	subscribed map[string]int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMongo creates the capped events collection of sizeBytes if needed
+func NewMongo(ctx context.Context, db *mongo.Database, eventsCollection string, sizeBytes int64) (*Mongo, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	err := db.CreateCollection(ctx, eventsCollection, options.CreateCollection().SetCapped(true).SetSizeInBytes(sizeBytes))
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Name == "NamespaceExists") {
+		return nil, err
+	}
+
+	presence := db.Collection("presence")
+	_, err = presence.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mongo{
+		events:     db.Collection(eventsCollection),
+		presence:   presence,
+		instance:   hex.EncodeToString(id),
+		subscribed: map[string]int{},
+	}, nil
+}
+
+// Start follows the events collection and refreshes this instance's
+// presence entries until Close
+func (m *Mongo) Start(handler Handler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handler != nil {
+		return errors.New("pubsub: already started")
+	}
+	m.handler = handler
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	last, err := m.newestEvent(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	m.wg.Add(2)
+	go m.tail(ctx, last)
+	go m.heartbeat(ctx)
+	return nil
+}
+
+func (m *Mongo) Publish(ctx context.Context, msg Message) error {
+	m.mu.RLock()
+	handler := m.handler
+	subscribed := wanted(m.subscribed, msg.User_ID)
+	m.mu.RUnlock()
+
+	if handler != nil && subscribed {
+		handler(msg)
+	}
+	_, err := m.events.InsertOne(ctx, mongoEvent{
+		ID:         primitive.NewObjectID(),
+		Origin:     m.instance,
+		Message:    msg,
+		Created_At: time.Now(),
+	})
+	return err
+}
+
+func (m *Mongo) Subscribe(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribed[userID]++
+}
+
+func (m *Mongo) Unsubscribe(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscribed[userID]--; m.subscribed[userID] <= 0 {
+		delete(m.subscribed, userID)
+	}
+}
+
+func (m *Mongo) RegisterPresence(ctx context.Context, p models.Presence) error {
+	id := m.instance + ":" + p.User_ID
+	if p.Status == models.PresenceOffline {
+		_, err := m.presence.DeleteOne(ctx, bson.M{"_id": id})
+		return err
+	}
+	_, err := m.presence.ReplaceOne(ctx, bson.M{"_id": id}, mongoPresence{
+		ID:         id,
+		User_ID:    p.User_ID,
+		Instance:   m.instance,
+		Status:     p.Status,
+		Last_Seen:  p.Last_Seen,
+		Expires_At: time.Now().Add(presenceTTL),
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *Mongo) Presence(ctx context.Context, userID string) (models.Presence, error) {
+	cursor, err := m.presence.Find(ctx, bson.M{"user_id": userID, "expires_at": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return models.Presence{}, err
+	}
+	var entries []mongoPresence
+	if err := cursor.All(ctx, &entries); err != nil {
+		return models.Presence{}, err
+	}
+	seen := make([]models.Presence, 0, len(entries))
+	for _, entry := range entries {
+		seen = append(seen, models.Presence{User_ID: userID, Status: entry.Status, Last_Seen: entry.Last_Seen})
+	}
+	return mergePresence(userID, seen), nil
+}
+
+// Close stops following events and removes this instance's presence
+// entries
+func (m *Mongo) Close() error {
+	if m.cancel != nil {
+		m.cancel()
+		m.wg.Wait()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.presence.DeleteMany(ctx, bson.M{"instance": m.instance})
+	return err
+}
+
+// newestEvent returns the id of the latest event so tailing starts after it
+// instead of replaying the collection
+func (m *Mongo) newestEvent(ctx context.Context) (primitive.ObjectID, error) {
+	var event mongoEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "$natural", Value: -1}})
+	err := m.events.FindOne(ctx, bson.M{}, opts).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return primitive.NilObjectID, nil
+	}
+	return event.ID, err
+}
+
+func (m *Mongo) tail(ctx context.Context, last primitive.ObjectID) {
+	defer m.wg.Done()
+	for ctx.Err() == nil {
+		last = m.follow(ctx, last)
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// follow reads the events inserted after last until the cursor dies, which
+// also happens right away while the collection is empty, and returns the
+// last id seen
+func (m *Mongo) follow(ctx context.Context, last primitive.ObjectID) primitive.ObjectID {
+	// Tailable cursors return capped collection documents in insertion
+	// order, whatever the filter
+	filter := bson.M{}
+	if !last.IsZero() {
+		filter["_id"] = bson.M{"$gte": primitive.NewObjectIDFromTimestamp(last.Timestamp().Add(-resumeWindow))}
+	}
+	opts := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(time.Second)
+	cursor, err := m.events.Find(ctx, filter, opts)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("pubsub: failed to open events cursor: %v", err)
+		}
+		return last
+	}
+	defer cursor.Close(context.Background())
+
+	skip := resumeAfter(last)
+	for {
+		var more bool
+		if skip.skipping() {
+			// Until last turns up only read what is already there
+			if more = cursor.TryNext(ctx); !more && cursor.Err() == nil && cursor.ID() != 0 {
+				log.Printf("pubsub: event %s was overwritten before it was read; some events may have been missed", last.Hex())
+				skip.found = true
+				continue
+			}
+		} else {
+			more = cursor.Next(ctx)
+		}
+		if !more {
+			break
+		}
+
+		var event mongoEvent
+		if err := cursor.Decode(&event); err != nil {
+			log.Printf("pubsub: failed to decode event: %v", err)
+			continue
+		}
+		if !skip.deliver(event.ID) {
+			continue
+		}
+		last = event.ID
+		// Our own events were delivered when published
+		if event.Origin == m.instance {
+			continue
+		}
+		m.mu.RLock()
+		subscribed := wanted(m.subscribed, event.User_ID)
+		m.mu.RUnlock()
+		if subscribed {
+			m.handler(event.Message)
+		}
+	}
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("pubsub: events cursor closed: %v", err)
+	}
+	return last
+}
+
+// resume skips the events a reopened cursor had already read: everything up
+// to and including the last one, in insertion order
+type resume struct {
+	last  primitive.ObjectID
+	found bool
+}
+
+func resumeAfter(last primitive.ObjectID) *resume {
+	return &resume{last: last, found: last.IsZero()}
+}
+
+func (r *resume) skipping() bool {
+	return !r.found
+}
+
+// deliver reports whether the event with id, the next in insertion order,
+// is new
+func (r *resume) deliver(id primitive.ObjectID) bool {
+	if r.found {
+		return true
+	}
+	r.found = id == r.last
+	return false
+}
+
+// heartbeat keeps this instance's presence entries from expiring
+func (m *Mongo) heartbeat(ctx context.Context) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := m.presence.UpdateMany(ctx,
+				bson.M{"instance": m.instance},
+				bson.M{"$set": bson.M{"expires_at": time.Now().Add(presenceTTL)}},
+			)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("pubsub: failed to refresh presence: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Package pubsub carries WebSocket events between API instances. Every
+// instance subscribes to the users connected to it and receives the messages
+// published for them, wherever they were published.
+package pubsub
+
+import (
+	"context"
+	"my-work/models"
+)
+
+// Message kinds
+const (
+	// KindEvent carries a JSON event for the user's sockets
+	KindEvent = "event"
+	// KindDisconnect closes the user's sockets; the payload is the reason
+	KindDisconnect = "disconnect"
+)
+
+// AllInstances as the User_ID sends a message to every instance, whoever
+// they are subscribed to, e.g. to invalidate caches
+const AllInstances = "*"
+
+// Message is published for one user, or for AllInstances
+type Message struct {
+	User_ID string `bson:"user_id"`
+	Kind    string `bson:"kind"`
+	Payload []byte `bson:"payload"`
+}
+
+// Handler receives the messages for subscribed users
+type Handler func(Message)
+
+// PubSub is the transport behind hub.Hub
+type PubSub interface {
+	// Start begins delivering messages to handler. It is called once.
+	Start(handler Handler) error
+	// Publish sends msg to every instance subscribed to msg.User_ID
+	Publish(ctx context.Context, msg Message) error
+	// Subscribe and Unsubscribe set which users this instance receives
+	// messages for
+	Subscribe(userID string)
+	Unsubscribe(userID string)
+	// RegisterPresence records the user's presence as seen by this instance.
+	// Offline removes it.
+	RegisterPresence(ctx context.Context, p models.Presence) error
+	// Presence combines what every instance registered for the user
+	Presence(ctx context.Context, userID string) (models.Presence, error)
+	Close() error
+}
+
+// wanted reports whether an instance with these subscriptions receives
+// messages for userID
+func wanted(subscribed map[string]int, userID string) bool {
+	return userID == AllInstances || subscribed[userID] > 0
+}
+
+// mergePresence combines per-instance presences: online anywhere beats away
+// anywhere, and a user nobody registered is offline
+func mergePresence(userID string, seen []models.Presence) models.Presence {
+	merged := models.Presence{User_ID: userID, Status: models.PresenceOffline}
+	for _, p := range seen {
+		if p.Last_Seen != nil && (merged.Last_Seen == nil || p.Last_Seen.After(*merged.Last_Seen)) {
+			merged.Last_Seen = p.Last_Seen
+		}
+		switch {
+		case p.Status == models.PresenceOnline:
+			merged.Status = models.PresenceOnline
+		case p.Status == models.PresenceAway && merged.Status == models.PresenceOffline:
+			merged.Status = models.PresenceAway
+		}
+	}
+	return merged
+}
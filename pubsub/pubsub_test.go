@@ -0,0 +1,183 @@
+package pubsub
+
+import (
+	"context"
+	"my-work/models"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(m *Memory)
+		userID  string
+		deliver bool
+	}{
+		{"subscribed", func(m *Memory) { m.Subscribe("u1") }, "u1", true},
+		{"not subscribed", func(m *Memory) { m.Subscribe("u2") }, "u1", false},
+		{"unsubscribed", func(m *Memory) { m.Subscribe("u1"); m.Unsubscribe("u1") }, "u1", false},
+		{"still subscribed by another connection", func(m *Memory) {
+			m.Subscribe("u1")
+			m.Subscribe("u1")
+			m.Unsubscribe("u1")
+		}, "u1", true},
+		{"extra unsubscribe", func(m *Memory) {
+			m.Unsubscribe("u1")
+			m.Subscribe("u1")
+		}, "u1", true},
+		{"all instances", func(m *Memory) {}, AllInstances, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemory()
+			var got []Message
+			if err := m.Start(func(msg Message) { got = append(got, msg) }); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(m)
+			msg := Message{User_ID: tt.userID, Kind: KindEvent, Payload: []byte(`{}`)}
+			if err := m.Publish(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+			if delivered := len(got) == 1; delivered != tt.deliver {
+				t.Errorf("delivered %v, want %v", got, tt.deliver)
+			}
+		})
+	}
+}
+
+func TestMemoryStartOnce(t *testing.T) {
+	m := NewMemory()
+	if err := m.Start(func(Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(func(Message) {}); err == nil {
+		t.Error("second Start accepted")
+	}
+}
+
+func TestMemoryPublishBeforeStart(t *testing.T) {
+	m := NewMemory()
+	m.Subscribe("u1")
+	if err := m.Publish(context.Background(), Message{User_ID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryPresence(t *testing.T) {
+	ctx := context.Background()
+	seen := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		register []models.Presence
+		want     string
+	}{
+		{"never registered", nil, models.PresenceOffline},
+		{"online", []models.Presence{{User_ID: "u1", Status: models.PresenceOnline}}, models.PresenceOnline},
+		{"away", []models.Presence{{User_ID: "u1", Status: models.PresenceAway}}, models.PresenceAway},
+		{"latest wins", []models.Presence{
+			{User_ID: "u1", Status: models.PresenceOnline},
+			{User_ID: "u1", Status: models.PresenceAway},
+		}, models.PresenceAway},
+		{"offline removes", []models.Presence{
+			{User_ID: "u1", Status: models.PresenceOnline},
+			{User_ID: "u1", Status: models.PresenceOffline, Last_Seen: &seen},
+		}, models.PresenceOffline},
+		{"other user", []models.Presence{{User_ID: "u2", Status: models.PresenceOnline}}, models.PresenceOffline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemory()
+			for _, p := range tt.register {
+				if err := m.RegisterPresence(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p, err := m.Presence(ctx, "u1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.User_ID != "u1" || p.Status != tt.want {
+				t.Errorf("Presence = %+v, want %s", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePresence(t *testing.T) {
+	early := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+	tests := []struct {
+		name     string
+		seen     []models.Presence
+		status   string
+		lastSeen *time.Time
+	}{
+		{"nobody", nil, models.PresenceOffline, nil},
+		{"online beats away", []models.Presence{{Status: models.PresenceAway}, {Status: models.PresenceOnline}}, models.PresenceOnline, nil},
+		{"away beats offline", []models.Presence{{Status: models.PresenceOffline}, {Status: models.PresenceAway}}, models.PresenceAway, nil},
+		{"latest last seen", []models.Presence{
+			{Status: models.PresenceAway, Last_Seen: &late},
+			{Status: models.PresenceOnline, Last_Seen: &early},
+		}, models.PresenceOnline, &late},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := mergePresence("u1", tt.seen)
+			if p.User_ID != "u1" || p.Status != tt.status {
+				t.Errorf("mergePresence = %+v, want %s", p, tt.status)
+			}
+			if (p.Last_Seen == nil) != (tt.lastSeen == nil) || (p.Last_Seen != nil && !p.Last_Seen.Equal(*tt.lastSeen)) {
+				t.Errorf("Last_Seen = %v, want %v", p.Last_Seen, tt.lastSeen)
+			}
+		})
+	}
+}
+
+func TestResumeAfter(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// Events in insertion order; b came from an instance whose clock is
+	// behind, so its id sorts before a's
+	a := primitive.NewObjectIDFromTimestamp(base)
+	b := primitive.NewObjectIDFromTimestamp(base.Add(-30 * time.Second))
+	c := primitive.NewObjectIDFromTimestamp(base.Add(time.Second))
+	d := primitive.NewObjectIDFromTimestamp(base.Add(-time.Minute))
+	inserted := []primitive.ObjectID{a, b, c, d}
+
+	tests := []struct {
+		name string
+		last primitive.ObjectID
+		want []primitive.ObjectID
+	}{
+		{"from the start", primitive.NilObjectID, []primitive.ObjectID{a, b, c, d}},
+		{"after a", a, []primitive.ObjectID{b, c, d}},
+		{"after b", b, []primitive.ObjectID{c, d}},
+		{"after c", c, []primitive.ObjectID{d}},
+		{"after the newest", d, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skip := resumeAfter(tt.last)
+			var got []primitive.ObjectID
+			for _, id := range inserted {
+				if skip.deliver(id) {
+					got = append(got, id)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("delivered %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("delivered %v, want %v", got, tt.want)
+				}
+			}
+			if skip.skipping() {
+				t.Error("still skipping after last was read")
+			}
+		})
+	}
+}
@@ -3,35 +3,89 @@ package routes
 import (
 	"my-work/config"
 	"my-work/controllers"
+	"my-work/middleware"
+	"my-work/models"
 	"my-work/websocket"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 func UserRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
 	incomingRoutes.POST("/logout", controllers.Logout(app))
-	incomingRoutes.POST("/message", controllers.SendText(app))
+	apiKeyRoute(incomingRoutes, http.MethodPost, "/message", models.ScopeChatWrite, controllers.SendText(app))
 	// incomingRoutes.POST("/watchchats", controllers.WatchChats(app))
 
-	incomingRoutes.POST("/chatlist", controllers.GetChats(app))
-	incomingRoutes.POST("/getmessages", controllers.GetMessages(app))
-	incomingRoutes.POST("/myprofile", controllers.MyProfile(app))
+	apiKeyRoute(incomingRoutes, http.MethodPost, "/chatlist", models.ScopeChatRead, controllers.GetChats(app))
+	apiKeyRoute(incomingRoutes, http.MethodPost, "/getmessages", models.ScopeChatRead, controllers.GetMessages(app))
+	apiKeyRoute(incomingRoutes, http.MethodPost, "/conversations/:id/read", models.ScopeChatWrite, controllers.ReadConversation(app))
+	apiKeyRoute(incomingRoutes, http.MethodPatch, "/messages/:id", models.ScopeChatWrite, controllers.EditMessage(app))
+	apiKeyRoute(incomingRoutes, http.MethodDelete, "/messages/:id", models.ScopeChatWrite, controllers.DeleteMessage(app))
+	apiKeyRoute(incomingRoutes, http.MethodPost, "/myprofile", models.ScopeProfileRead, controllers.MyProfile(app))
 	incomingRoutes.POST("/uploadphotoforulala", controllers.UploadUlalaImageAndReturnUrl(app))
+	incomingRoutes.GET("/sessions", controllers.ListSessions(app))
+	incomingRoutes.DELETE("/sessions/:id", controllers.RevokeSession(app))
+	incomingRoutes.POST("/2fa/setup", controllers.SetupTwoFactor(app))
+	incomingRoutes.POST("/2fa/confirm", controllers.ConfirmTwoFactor(app))
+	incomingRoutes.POST("/2fa/disable", controllers.DisableTwoFactor(app))
+	incomingRoutes.POST("/me/export", controllers.RequestDataExport(app))
+	incomingRoutes.GET("/me/export/:id", controllers.GetDataExport(app))
+	incomingRoutes.DELETE("/me", controllers.DeleteAccount(app))
+	incomingRoutes.POST("/me/email", controllers.RequestEmailChange(app))
+	incomingRoutes.POST("/me/email/confirm", controllers.ConfirmEmailChange(app))
+	incomingRoutes.POST("/me/password", controllers.ChangePassword(app))
+	incomingRoutes.POST("/apikeys", controllers.CreateAPIKey(app))
+	incomingRoutes.GET("/apikeys", controllers.ListAPIKeys(app))
+	incomingRoutes.DELETE("/apikeys/:id", controllers.RevokeAPIKey(app))
 
 }
 
 func PublicRoutes(incomingRoutes *gin.Engine, app *config.AppConfig) {
+	incomingRoutes.GET("/.well-known/jwks.json", controllers.JWKS(app))
 	incomingRoutes.POST("/imageverification", controllers.ImageVarification(app))
 	incomingRoutes.POST("/facedetect", controllers.ImageDetectFace(app))
 	incomingRoutes.POST("/getbytearray", controllers.GetByteArray())
 	incomingRoutes.POST("/signin", controllers.SignIn(app))
+	incomingRoutes.POST("/signin/2fa", controllers.SignInTwoFactor(app))
+	incomingRoutes.POST("/signin/magiclink", controllers.RequestMagicLink(app))
+	incomingRoutes.POST("/signin/magiclink/exchange", controllers.ExchangeMagicLink(app))
 	incomingRoutes.POST("/signup", controllers.SignUp(app))
 	incomingRoutes.POST("/accountvalidate", controllers.ValidateOtpAndSaveUser(app))
+	incomingRoutes.POST("/resendotp", controllers.ResendOTP(app))
+	incomingRoutes.GET("/oidc/:provider/login", controllers.OIDCLogin(app))
+	incomingRoutes.GET("/oidc/:provider/callback", controllers.OIDCCallback(app))
+	incomingRoutes.POST("/oidc/:provider/callback", controllers.OIDCCallback(app))
 	incomingRoutes.POST("/refreshtoken", controllers.RefreshToken(app))
+	incomingRoutes.POST("/forgotpassword", controllers.ForgotPassword(app))
+	incomingRoutes.POST("/resetpassword", controllers.ResetPassword(app))
+	incomingRoutes.POST("/unlockaccount/request", controllers.RequestAccountUnlock(app))
+	incomingRoutes.POST("/unlockaccount", controllers.UnlockAccount(app))
 }
 
 func WebSocketRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
-	incomingRoutes.GET("/ws/chats", websocket.HandleMessageListWebSocket(app))
-	incomingRoutes.GET("/ws/messages", websocket.HandleMessageListWebSocket(app))
+	apiKeyRoute(incomingRoutes, http.MethodGet, "/ws/chats", models.ScopeChatRead, websocket.HandleMessageListWebSocket(app))
+	apiKeyRoute(incomingRoutes, http.MethodGet, "/ws/messages", models.ScopeChatRead, websocket.HandleMessageListWebSocket(app))
 	// incomingRoutes.GET("/ws/messages", websocket.HandleMessageWebSocket(app))
+	apiKeyRoute(incomingRoutes, http.MethodGet, "/presence", models.ScopeChatRead, controllers.GetPresence(app))
+}
+
+// AdminRoutes are mounted under /api/admin behind RequireAuthWithRole
+func AdminRoutes(incomingRoutes *gin.RouterGroup, app *config.AppConfig) {
+	apiKeyRoute(incomingRoutes, http.MethodGet, "/users/:id", models.ScopeAdminRead, middleware.RequirePermission(models.PermissionViewUsers), controllers.AdminGetUser(app))
+	incomingRoutes.PUT("/users/:id/role", middleware.RequirePermission(models.PermissionManageRoles), controllers.AdminSetRole(app))
+
+	moderate := middleware.RequirePermission(models.PermissionModerate)
+	incomingRoutes.POST("/users/:id/suspend", moderate, controllers.AdminSuspendUser(app))
+	incomingRoutes.POST("/users/:id/ban", moderate, controllers.AdminBanUser(app))
+	incomingRoutes.DELETE("/users/:id/restriction", moderate, controllers.AdminLiftRestriction(app))
+	apiKeyRoute(incomingRoutes, http.MethodGet, "/users/:id/moderation", models.ScopeAdminRead, moderate, controllers.AdminModerationHistory(app))
+	incomingRoutes.GET("/users/:id/apikeys", moderate, controllers.AdminListAPIKeys(app))
+	incomingRoutes.DELETE("/users/:id/apikeys/:keyid", moderate, controllers.AdminRevokeAPIKey(app))
+}
+
+// apiKeyRoute registers a route that API keys with scope may also call.
+// Routes registered directly on the group only accept bearer tokens.
+func apiKeyRoute(group *gin.RouterGroup, method, path, scope string, handlers ...gin.HandlerFunc) {
+	middleware.AllowAPIKey(method, group.BasePath()+path, scope)
+	group.Handle(method, path, handlers...)
 }
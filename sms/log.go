@@ -0,0 +1,46 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogSender writes messages to a file, or to the server log when no file is
+// set, instead of delivering them. Use it for local development.
+type LogSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewLogSender(path string) *LogSender {
+	return &LogSender{Path: path}
+}
+
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validate(msg); err != nil {
+		return err
+	}
+
+	if s.Path == "" {
+		log.Printf("SMS to %s: %s", msg.To, msg.Body)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open SMS log: %w", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339), msg.To, msg.Body)
+	return err
+}
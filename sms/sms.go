@@ -0,0 +1,48 @@
+// Package sms sends text messages such as sign-in codes to phone numbers.
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Message is a text message to a single E.164 phone number
+type Message struct {
+	To   string
+	Body string
+}
+
+// SMSSender delivers text messages
+type SMSSender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var ErrInvalidPhone = errors.New("sms: phone number must be in E.164 format, e.g. +14155550100")
+
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// phoneSeparators are characters people commonly type inside phone numbers
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "")
+
+// NormalizePhone strips spaces, dashes, dots and brackets and checks that
+// what's left is an E.164 number
+func NormalizePhone(phone string) (string, error) {
+	normalized := phoneSeparators.Replace(strings.TrimSpace(phone))
+	if !e164.MatchString(normalized) {
+		return "", ErrInvalidPhone
+	}
+	return normalized, nil
+}
+
+func validate(msg Message) error {
+	if !e164.MatchString(msg.To) {
+		return fmt.Errorf("sms: invalid recipient %q: %w", msg.To, ErrInvalidPhone)
+	}
+	if msg.Body == "" {
+		return errors.New("sms: empty message body")
+	}
+	return nil
+}
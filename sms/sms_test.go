@@ -0,0 +1,68 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"+14155550100", "+14155550100", false},
+		{" +1 (415) 555-0100 ", "+14155550100", false},
+		{"+44 20.7946.0958", "+442079460958", false},
+		{"+4915112345678", "+4915112345678", false},
+		// Shortest and longest E.164 numbers
+		{"+12345678", "+12345678", false},
+		{"+123456789012345", "+123456789012345", false},
+		{"+1234567", "", true},
+		{"+1234567890123456", "", true},
+		{"14155550100", "", true},
+		{"0014155550100", "", true},
+		{"+04155550100", "", true},
+		{"+1 415 555 010O", "", true},
+		{"+1/415/555/0100", "", true},
+		{"", "", true},
+		{"+", "", true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizePhone(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("NormalizePhone(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPhone) {
+			t.Errorf("NormalizePhone(%q) error %v is not ErrInvalidPhone", tt.in, err)
+		}
+	}
+}
+
+func TestLogSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.log")
+	s := NewLogSender(path)
+	ctx := context.Background()
+
+	if err := s.Send(ctx, Message{To: "+14155550100", Body: "code 123456"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(ctx, Message{To: "4155550100", Body: "code"}); !errors.Is(err, ErrInvalidPhone) {
+		t.Errorf("unnormalized recipient: err = %v", err)
+	}
+	if err := s.Send(ctx, Message{To: "+14155550100"}); err == nil {
+		t.Error("empty body accepted")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], "\t+14155550100\tcode 123456") {
+		t.Errorf("log = %q", data)
+	}
+}
@@ -0,0 +1,46 @@
+package token
+
+import (
+	"errors"
+	"my-work/config"
+	"my-work/models"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Purposes for challenge tokens
+const (
+	PurposeTwoFactor = "2fa"
+)
+
+// GenerateChallengeToken issues a short-lived token that only proves the
+// holder passed the first step of a multi-step flow. It can't be used as an
+// access token. The token's jti is returned so callers can make it single
+// use.
+func GenerateChallengeToken(uid, purpose string, ttl time.Duration, app *config.AppConfig) (string, string, error) {
+	claims := &models.SigningDetails{
+		UID:     uid,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "myWork",
+			ID:        generateRandomID(16),
+		},
+	}
+	signed, err := signClaims(claims, app)
+	return signed, claims.ID, err
+}
+
+// ValidateChallengeToken checks a challenge token was issued for purpose
+func ValidateChallengeToken(tokenString, purpose string, app *config.AppConfig) (*models.SigningDetails, error) {
+	claims, err := ValidateToken(tokenString, app)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, errors.New("token was not issued for this step")
+	}
+	return claims, nil
+}
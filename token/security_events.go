@@ -0,0 +1,22 @@
+package token
+
+import (
+	"context"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"time"
+)
+
+// LogSecurityEvent stores an audit record and mirrors it to the server log
+func LogSecurityEvent(mctx context.Context, app *config.AppConfig, event models.SecurityEvent) {
+	if event.Created_At.IsZero() {
+		event.Created_At = time.Now()
+	}
+	log.Printf("SECURITY %s user=%s session=%s ip=%s: %s", event.Type, event.User_ID, event.Session_ID, event.IP, event.Details)
+
+	_, err := app.Client.Database("talkmore").Collection("securityEvents").InsertOne(mctx, event)
+	if err != nil {
+		log.Printf("Failed to store security event %s for user %s: %v", event.Type, event.User_ID, err)
+	}
+}
@@ -0,0 +1,208 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"log"
+	"my-work/config"
+	"my-work/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var sessionIndexOnce sync.Once
+
+func sessionsCollection(app *config.AppConfig) *mongo.Collection {
+	return app.Client.Database("talkmore").Collection("sessions")
+}
+
+func refreshTokensCollection(app *config.AppConfig) *mongo.Collection {
+	return app.Client.Database("talkmore").Collection("refreshTokens")
+}
+
+// ensureSessionIndexes creates the TTL and lookup indexes on sessions and
+// refreshTokens (run once)
+func ensureSessionIndexes(mctx context.Context, app *config.AppConfig) {
+	sessionIndexOnce.Do(func() {
+		_, err := refreshTokensCollection(app).Indexes().CreateMany(mctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+			{
+				Keys: bson.D{{Key: "family_id", Value: 1}},
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to create refresh token indexes: %v", err)
+		}
+
+		_, err = sessionsCollection(app).Indexes().CreateMany(mctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+			{
+				Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_used_at", Value: -1}},
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to create session indexes: %v", err)
+		}
+	})
+}
+
+// StartSession issues a token pair for a new device and records the session
+func StartSession(mctx context.Context, app *config.AppConfig, user models.SetSignUpModel, meta models.SessionMeta) (models.TokenPair, error) {
+	ensureSessionIndexes(mctx, app)
+
+	uid := user.User_ID
+	tokenPair, err := GenerateTokenPair(user.Email, uid, user.Role, "", app)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		ID:           tokenPair.SessionID,
+		User_ID:      uid,
+		Refresh_ID:   tokenPair.RefreshID,
+		Device_Name:  meta.DeviceName,
+		IP:           meta.IP,
+		User_Agent:   meta.UserAgent,
+		Created_At:   now,
+		Last_Used_At: now,
+		Expires_At:   now.Add(refreshTokenTTL),
+		Revoked:      false,
+	}
+	if _, err := sessionsCollection(app).InsertOne(mctx, session); err != nil {
+		return models.TokenPair{}, err
+	}
+	if err := storeRefreshToken(mctx, app, uid, tokenPair); err != nil {
+		return models.TokenPair{}, err
+	}
+	return tokenPair, nil
+}
+
+// storeRefreshToken records a newly issued refresh token in its family
+func storeRefreshToken(mctx context.Context, app *config.AppConfig, uid string, tokenPair models.TokenPair) error {
+	now := time.Now()
+	_, err := refreshTokensCollection(app).InsertOne(mctx, models.RefreshTokenRecord{
+		ID:         tokenPair.RefreshID,
+		Family_ID:  tokenPair.SessionID,
+		User_ID:    uid,
+		Consumed:   false,
+		Issued_At:  now,
+		Expires_At: now.Add(refreshTokenTTL),
+	})
+	return err
+}
+
+// revokeFamily revokes a session and consumes every refresh token issued to it
+func revokeFamily(mctx context.Context, app *config.AppConfig, uid, familyID, reason string) error {
+	now := time.Now()
+	_, err := sessionsCollection(app).UpdateOne(
+		mctx,
+		bson.M{"_id": familyID, "user_id": uid},
+		bson.M{"$set": bson.M{"revoked": true, "revoked_reason": reason, "last_used_at": now}},
+	)
+	if err != nil {
+		return err
+	}
+	app.Principals.InvalidateSession(uid, familyID)
+	_, err = refreshTokensCollection(app).UpdateMany(
+		mctx,
+		bson.M{"family_id": familyID, "consumed": false},
+		bson.M{"$set": bson.M{"consumed": true, "consumed_at": now}},
+	)
+	return err
+}
+
+// IsNewDevice reports whether a user with existing sessions is signing in
+// from a user agent none of them used
+func IsNewDevice(mctx context.Context, app *config.AppConfig, uid string, meta models.SessionMeta) bool {
+	total, err := sessionsCollection(app).CountDocuments(mctx, bson.M{"user_id": uid})
+	if err != nil || total == 0 {
+		return false
+	}
+	known, err := sessionsCollection(app).CountDocuments(mctx, bson.M{"user_id": uid, "user_agent": meta.UserAgent})
+	if err != nil {
+		return false
+	}
+	return known == 0
+}
+
+// ValidateSession checks that the session named in the claims is still live
+func ValidateSession(mctx context.Context, app *config.AppConfig, claims *models.SigningDetails) (*models.Session, error) {
+	if claims.SID == "" {
+		return nil, errors.New("token is not bound to a session")
+	}
+	var session models.Session
+	err := sessionsCollection(app).FindOne(mctx, bson.M{"_id": claims.SID, "user_id": claims.UID}).Decode(&session)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("session not found")
+		}
+		return nil, err
+	}
+	if session.Revoked {
+		return nil, errors.New("session has been revoked")
+	}
+	return &session, nil
+}
+
+// ListSessions returns the user's live sessions, most recently used first
+func ListSessions(mctx context.Context, app *config.AppConfig, uid string) ([]models.Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "last_used_at", Value: -1}})
+	cursor, err := sessionsCollection(app).Find(mctx, bson.M{"user_id": uid, "revoked": false}, opts)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []models.Session{}
+	if err := cursor.All(mctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes one of the user's sessions. It returns false when no
+// live session with that ID belongs to the user.
+func RevokeSession(mctx context.Context, app *config.AppConfig, uid, sessionID string) (bool, error) {
+	result, err := sessionsCollection(app).UpdateOne(
+		mctx,
+		bson.M{"_id": sessionID, "user_id": uid, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true, "last_used_at": time.Now()}},
+	)
+	if err != nil {
+		return false, err
+	}
+	app.Principals.InvalidateSession(uid, sessionID)
+	return result.MatchedCount > 0, nil
+}
+
+// RevokeAllSessions signs the user out of every device
+func RevokeAllSessions(mctx context.Context, app *config.AppConfig, uid string) error {
+	_, err := sessionsCollection(app).UpdateMany(
+		mctx,
+		bson.M{"user_id": uid, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	app.Principals.InvalidateUser(uid)
+	return err
+}
+
+// RevokeOtherSessions revokes every session of the user except keepSessionID,
+// e.g. after a password change on that session
+func RevokeOtherSessions(mctx context.Context, app *config.AppConfig, uid, keepSessionID string) error {
+	_, err := sessionsCollection(app).UpdateMany(
+		mctx,
+		bson.M{"user_id": uid, "revoked": false, "_id": bson.M{"$ne": keepSessionID}},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	app.Principals.InvalidateUser(uid)
+	return err
+}
@@ -12,15 +12,26 @@ import (
 
 	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// GenerateTokenPair creates a new access and refresh token pair
-func GenerateTokenPair(email, uid string, app *config.AppConfig) (models.TokenPair, error) {
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// GenerateTokenPair creates a new access and refresh token pair. An empty
+// sessionID starts a new session keyed by the refresh token's jti.
+func GenerateTokenPair(email, uid, role, sessionID string, app *config.AppConfig) (models.TokenPair, error) {
+	refreshID := generateRandomID(16) // Unique ID for revocation
+	if sessionID == "" {
+		sessionID = refreshID
+	}
+
 	// Access token claims (short-lived)
 	accessClaims := &models.SigningDetails{
 		Email: email,
 		UID:   uid,
+		SID:   sessionID,
+		Role:  models.NormalizeRole(role),
+		Type:  models.TokenTypeAccess,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(60 * time.Minute)), // 15 minutes
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -29,18 +40,18 @@ func GenerateTokenPair(email, uid string, app *config.AppConfig) (models.TokenPa
 	}
 
 	// Generate access token
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	signedAccessToken, err := accessToken.SignedString(app.SecretKey)
+	signedAccessToken, err := signClaims(accessClaims, app)
 	if err != nil {
 		return models.TokenPair{}, err
 	}
 
 	// Refresh token claims (longer-lived)
-	refreshID := generateRandomID(16) // Unique ID for revocation
 	refreshClaims := &models.SigningDetails{
-		UID: uid, // Include UID for validation
+		UID:  uid, // Include UID for validation
+		SID:  sessionID,
+		Type: models.TokenTypeRefresh,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)), // 30 days
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(refreshTokenTTL)), // 30 days
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "myWork",
 			ID:        refreshID, // Unique identifier (jti)
@@ -48,30 +59,57 @@ func GenerateTokenPair(email, uid string, app *config.AppConfig) (models.TokenPa
 	}
 
 	// Generate refresh token
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	signedRefreshToken, err := refreshToken.SignedString(app.SecretKey)
+	signedRefreshToken, err := signClaims(refreshClaims, app)
 	if err != nil {
 		return models.TokenPair{}, err
 	}
 
-	// // Store tokens in database
-	// err = updateTokens(signedAccessToken, signedRefreshToken, refreshID, uid, app)
-	// if err != nil {
-	// 	return models.TokenPair{}, err
-	// }
-
 	return models.TokenPair{
 		AccessToken:  signedAccessToken,
 		RefreshToken: signedRefreshToken,
+		SessionID:    sessionID,
+		RefreshID:    refreshID,
 	}, nil
 }
 
+// signClaims signs with the keyring's active key (setting the kid header),
+// or with HS256 and the shared secret when no keyring is configured
+func signClaims(claims jwt.Claims, app *config.AppConfig) (string, error) {
+	if app.Keyring == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.SecretKey)
+	}
+	key := app.Keyring.Active()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// ValidateToken verifies a token signed by any key in the keyring, active or
+// retired. Tokens without a kid are HS256 tokens signed with SecretKey; once
+// a keyring is configured they are only accepted until LegacyHS256Until.
 func ValidateToken(tokenString string, app *config.AppConfig) (*models.SigningDetails, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &models.SigningDetails{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.New("unexpected signing method")
+			}
+			if app.Keyring != nil && !time.Now().Before(app.LegacyHS256Until) {
+				return nil, errors.New("legacy HS256 tokens are no longer accepted")
+			}
+			return app.SecretKey, nil
+		}
+		if app.Keyring == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		key, ok := app.Keyring.Lookup(kid)
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		if t.Method.Alg() != key.Method.Alg() {
 			return nil, errors.New("unexpected signing method")
 		}
-		return app.SecretKey, nil
+		return key.Public, nil
 	})
 
 	if err != nil {
@@ -86,22 +124,38 @@ func ValidateToken(tokenString string, app *config.AppConfig) (*models.SigningDe
 	return claims, nil
 }
 
-// RefreshTokens generates a new token pair using a valid refresh token
-func RefreshTokens(refreshTokenString string, app *config.AppConfig) (models.TokenPair, error) {
+// RefreshTokens rotates a refresh token: the presented token is consumed and
+// a new pair in the same family (session) is issued. Presenting a token that
+// was already consumed means it leaked, so the whole family is revoked.
+func RefreshTokens(refreshTokenString string, meta models.SessionMeta, app *config.AppConfig) (models.TokenPair, error) {
 	// Validate the refresh token
 	claims, err := ValidateToken(refreshTokenString, app)
-	if err != nil {
+	if err != nil || claims.SID == "" || !claims.IsRefreshToken() {
 		return models.TokenPair{}, errors.New("invalid or expired refresh token")
 	}
 
-	// Optionally check if the refresh token is revoked in the database
 	mctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	filter := bson.M{
-		"user_id":       claims.UID,
-		"refresh_token": refreshTokenString,
+
+	// Consume the token atomically so two racing requests can't both use it
+	now := time.Now()
+	var record models.RefreshTokenRecord
+	err = refreshTokensCollection(app).FindOneAndUpdate(
+		mctx,
+		bson.M{"_id": claims.ID, "family_id": claims.SID, "user_id": claims.UID, "consumed": false},
+		bson.M{"$set": bson.M{"consumed": true, "consumed_at": now}},
+	).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return models.TokenPair{}, handleUnusableRefreshToken(mctx, app, claims, meta)
+	}
+	if err != nil {
+		log.Printf("Failed to consume refresh token: %v", err)
+		return models.TokenPair{}, errors.New("failed to refresh tokens")
 	}
-	count, err := app.Client.Database("talkmore").Collection("users").CountDocuments(mctx, filter)
+
+	// The family itself must still be live
+	filter := bson.M{"_id": claims.SID, "user_id": claims.UID, "revoked": false}
+	count, err := sessionsCollection(app).CountDocuments(mctx, filter)
 	if err != nil || count == 0 {
 		return models.TokenPair{}, errors.New("refresh token not found or revoked")
 	}
@@ -114,29 +168,56 @@ func RefreshTokens(refreshTokenString string, app *config.AppConfig) (models.Tok
 		return models.TokenPair{}, errors.New("user not found")
 	}
 
-	newTokenPair, err := GenerateTokenPair(user.Email, claims.UID, app)
+	newTokenPair, err := GenerateTokenPair(user.Email, claims.UID, user.Role, claims.SID, app)
 	if err != nil {
 		return models.TokenPair{}, err
 	}
+	if err := storeRefreshToken(mctx, app, claims.UID, newTokenPair); err != nil {
+		log.Printf("Failed to store refresh token: %v", err)
+		return models.TokenPair{}, errors.New("failed to update tokens")
+	}
 
-	// Update the user's tokens in the database
-	_, err = app.Client.Database("talkmore").Collection("users").UpdateOne(
+	// Move the session on to the new refresh token
+	_, err = sessionsCollection(app).UpdateOne(
 		mctx,
-		bson.M{"user_id": claims.UID},
+		filter,
 		bson.M{"$set": bson.M{
-			"token":         newTokenPair.AccessToken,
-			"refresh_token": newTokenPair.RefreshToken,
-			"updated_at":    time.Now(),
+			"refresh_id":   newTokenPair.RefreshID,
+			"last_used_at": now,
+			"expires_at":   now.Add(refreshTokenTTL),
 		}},
 	)
 	if err != nil {
-		log.Printf("Failed to update tokens: %v", err)
+		log.Printf("Failed to update session: %v", err)
 		return models.TokenPair{}, errors.New("failed to update tokens")
 	}
 
 	return newTokenPair, nil
 }
 
+// handleUnusableRefreshToken works out why a refresh token couldn't be
+// consumed and revokes its family when the token is being replayed
+func handleUnusableRefreshToken(mctx context.Context, app *config.AppConfig, claims *models.SigningDetails, meta models.SessionMeta) error {
+	var record models.RefreshTokenRecord
+	err := refreshTokensCollection(app).FindOne(mctx, bson.M{"_id": claims.ID}).Decode(&record)
+	if err != nil || !record.Consumed || record.Family_ID != claims.SID {
+		return errors.New("refresh token not found or revoked")
+	}
+
+	if err := revokeFamily(mctx, app, record.User_ID, record.Family_ID, models.SecurityEventRefreshReuse); err != nil {
+		log.Printf("Failed to revoke token family %s: %v", record.Family_ID, err)
+	}
+	LogSecurityEvent(mctx, app, models.SecurityEvent{
+		User_ID:    record.User_ID,
+		Type:       models.SecurityEventRefreshReuse,
+		Session_ID: record.Family_ID,
+		IP:         meta.IP,
+		User_Agent: meta.UserAgent,
+		Details:    "consumed refresh token " + record.ID + " was presented again; session revoked",
+	})
+	return errors.New("refresh token reuse detected, session revoked")
+}
+
 func generateRandomID(length int) string {
 	b := make([]byte, length)
 	_, err := rand.Read(b)
@@ -146,29 +227,3 @@ func generateRandomID(length int) string {
 	}
 	return hex.EncodeToString(b)
 }
-
-// updateTokens stores tokens in MongoDB
-func updateTokens(accessToken, refreshToken, refreshID, userID string, app *config.AppConfig) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	updateObj := bson.D{
-		{Key: "token", Value: accessToken},
-		{Key: "refresh_token", Value: refreshToken},
-		{Key: "refresh_id", Value: refreshID}, // Store for revocation
-		{Key: "updated_at", Value: time.Now()},
-	}
-
-	upsert := true
-	filter := bson.M{"user_id": userID}
-	opts := options.UpdateOptions{Upsert: &upsert}
-
-	_, err := app.Client.Database("talkmore").Collection("users").UpdateOne(ctx, filter, bson.D{
-		{Key: "$set", Value: updateObj},
-	}, &opts)
-	if err != nil {
-		log.Printf("Failed to update tokens: %v", err)
-		return err
-	}
-	return nil
-}
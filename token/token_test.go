@@ -0,0 +1,90 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"my-work/config"
+	"my-work/keyring"
+	"my-work/models"
+)
+
+// writeKey writes a fresh Ed25519 private key to dir and returns its path
+func writeKey(t *testing.T, dir, name string) string {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadKeyring(t *testing.T, active string, retired ...string) *keyring.Keyring {
+	t.Helper()
+	ring, err := keyring.Load(active, retired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestValidateTokenAfterRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := writeKey(t, dir, "old.pem"), writeKey(t, dir, "new.pem")
+
+	before := &config.AppConfig{Keyring: loadKeyring(t, oldKey)}
+	pair, err := GenerateTokenPair("a@example.com", "u1", models.RoleUser, "", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := &config.AppConfig{Keyring: loadKeyring(t, newKey, oldKey)}
+	if _, err := ValidateToken(pair.AccessToken, rotated); err != nil {
+		t.Errorf("token signed by the retired key rejected: %v", err)
+	}
+
+	dropped := &config.AppConfig{Keyring: loadKeyring(t, newKey)}
+	if _, err := ValidateToken(pair.AccessToken, dropped); err == nil {
+		t.Error("token signed by a dropped key accepted")
+	}
+}
+
+func TestValidateTokenLegacyHS256(t *testing.T) {
+	secret := []byte("shared-secret")
+	legacy, err := GenerateTokenPair("a@example.com", "u1", models.RoleUser, "", &config.AppConfig{SecretKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := loadKeyring(t, writeKey(t, t.TempDir(), "active.pem"))
+
+	tests := []struct {
+		name string
+		app  *config.AppConfig
+		ok   bool
+	}{
+		{"no keyring", &config.AppConfig{SecretKey: secret}, true},
+		{"keyring without cutoff", &config.AppConfig{SecretKey: secret, Keyring: ring}, false},
+		{"before cutoff", &config.AppConfig{SecretKey: secret, Keyring: ring, LegacyHS256Until: time.Now().Add(time.Hour)}, true},
+		{"after cutoff", &config.AppConfig{SecretKey: secret, Keyring: ring, LegacyHS256Until: time.Now().Add(-time.Hour)}, false},
+	}
+	for _, tt := range tests {
+		_, err := ValidateToken(legacy.AccessToken, tt.app)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want accepted = %v", tt.name, err, tt.ok)
+		}
+	}
+}
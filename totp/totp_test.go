@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the RFC 6238 SHA-1 test key "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC lists 8-digit codes; these are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"same step", now, true},
+		{"one step later", now.Add(Period), true},
+		{"one step earlier", now.Add(-Period), true},
+		{"two steps later", now.Add(2 * Period), false},
+	}
+	for _, tt := range tests {
+		if _, ok := Match(rfcSecret, code, tt.at); ok != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+	if _, ok := Match(rfcSecret, "000000", now); ok {
+		t.Error("wrong code matched")
+	}
+}
@@ -5,11 +5,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 
 	"my-work/config"
 	"my-work/controllers"
+	"my-work/hub"
 	"my-work/models"
 	"my-work/utils"
 
@@ -17,8 +17,10 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var chatClients = make(map[string]map[*websocket.Conn]bool) // user_id → WebSocket connections
-var chatMutex sync.Mutex
+const (
+	writeWait  = 10 * time.Second
+	pingPeriod = 30 * time.Second
+)
 
 // WebSocket upgrader
 var upgrader = websocket.Upgrader{
@@ -27,6 +29,41 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// writePump is the only writer of ws. It drains the client's hub queue and
+// pings the peer until the hub closes the client, then sends the close frame.
+func writePump(ws *websocket.Conn, client *hub.Client) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		ws.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-client.Send():
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Printf("Error sending data over WebSocket for user %s: %v", client.UserID, err)
+				return
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-client.Done():
+			code, reason := client.CloseReason()
+			closeMessage := websocket.FormatCloseMessage(code, reason)
+			if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil && code != hub.CloseNormal {
+				log.Printf("Failed to send close frame to user %s: %v", client.UserID, err)
+			}
+			if reason != "" {
+				log.Printf("Closed WebSocket connection for user %s: %s", client.UserID, reason)
+			}
+			return
+		}
+	}
+}
+
 // FetchInitialChats retrieves and sends a paginated list of chat data for a user
 
 func HandleChatListWebSocket(app *config.AppConfig) gin.HandlerFunc {
@@ -40,53 +77,24 @@ func HandleChatListWebSocket(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		chatMutex.Lock()
-		if chatClients[userID] == nil {
-			chatClients[userID] = make(map[*websocket.Conn]bool)
-		}
-		chatClients[userID][ws] = true
-		chatMutex.Unlock()
-
+		client := app.Hub.Register(userID)
 		log.Printf("New WebSocket connection for user %s", userID)
 
 		defer func() {
-			chatMutex.Lock()
-			delete(chatClients[userID], ws)
-			if len(chatClients[userID]) == 0 {
-				delete(chatClients, userID)
-			}
-			chatMutex.Unlock()
-			ws.Close()
+			app.Hub.Unregister(client)
 			log.Printf("WebSocket connection closed for user %s", userID)
 		}()
 
 		// Start watching for changes
-		go utils.WatchChatsCollection(app, userID, ws)
+		go utils.WatchChatsCollection(app, userID, client)
 
-		// Keep connection alive
-		for {
-			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				return
-			}
-			time.Sleep(30 * time.Second)
-		}
+		writePump(ws, client)
 	}
 }
 func HandleMessageListWebSocket(app *config.AppConfig) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-
-		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		clientToken, tokenError := controllers.GetMyToken(ctx)
-		if tokenError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": tokenError})
-			ctx.Abort()
-			return
-		}
-		userDetails, idError := controllers.GetMyId(mctx, app, clientToken)
-		if idError != "" {
-			ctx.JSON(http.StatusUnauthorized, gin.H{"error": idError})
-			ctx.Abort()
+		userDetails := controllers.CurrentPrincipal(ctx)
+		if userDetails == nil {
 			return
 		}
 		userID := userDetails.UserID
@@ -98,31 +106,22 @@ func HandleMessageListWebSocket(app *config.AppConfig) gin.HandlerFunc {
 			return
 		}
 
-		chatMutex.Lock()
-		if chatClients[userID] == nil {
-			chatClients[userID] = make(map[*websocket.Conn]bool)
-		}
-		chatClients[userID][ws] = true
-		chatMutex.Unlock()
+		client := app.Hub.Register(userID)
+		connectPresence(app, userID, client)
 
 		log.Printf("New WebSocket connection for user %s", userID)
 
-		done := make(chan struct{})
-
 		defer func() {
-			chatMutex.Lock()
-			delete(chatClients[userID], ws)
-			if len(chatClients[userID]) == 0 {
-				delete(chatClients, userID)
-			}
-			chatMutex.Unlock()
-			close(done) // Signal goroutine to stop
-			ws.Close()
+			disconnectPresence(app, userID, client)
+			// Stops the write pump, which closes the socket
+			app.Hub.Unregister(client)
 			log.Printf("WebSocket connection closed for user %s", userID)
 		}()
 
-		go utils.WatchMessagesCollection(app, userID, ws, done)
+		go writePump(ws, client)
 
+		// Conversations this connection may send typing frames to
+		joined := map[string]bool{}
 		for {
 			_, message, err := ws.ReadMessage()
 			if err != nil {
@@ -135,13 +134,55 @@ func HandleMessageListWebSocket(app *config.AppConfig) gin.HandlerFunc {
 				}
 				return
 			}
+			if !allowFrame(userDetails, client) {
+				continue
+			}
+			var event models.ClientEvent
+			if err := json.Unmarshal(message, &event); err == nil {
+				switch event.Type {
+				case models.ClientEventRead:
+					go markRead(app, userID, event)
+					continue
+				case models.ClientEventTypingStart, models.ClientEventTypingStop:
+					relayTyping(app, userID, joined, event)
+					continue
+				case models.ClientEventPresence:
+					setPresence(app, userID, client, event.Status)
+					continue
+				}
+			}
 			log.Printf("Received message from user %s: %s", userID, string(message))
 			var messageDetails models.Message
 			if err := json.Unmarshal(message, &messageDetails); err != nil {
 				log.Printf("Error decoding JSON message from user %s: %v", userDetails.UserID, err)
 				continue // Skip invalid messages
 			}
-			go utils.HandleClientMessage(app, *userDetails, messageDetails)
+			go utils.HandleClientMessage(app, userDetails.UserDetails, messageDetails)
 		}
 	}
 }
+
+// allowFrame checks the caller may send a frame. Every frame changes
+// something (a message, a read cursor, typing or presence), so API keys need
+// chat:write; chat:read only lets them listen. A refused frame is answered
+// with an error event.
+func allowFrame(principal *models.Principal, client *hub.Client) bool {
+	if principal.HasScope(models.ScopeChatWrite) {
+		return true
+	}
+	client.SendJSON(gin.H{
+		"type":    models.WebSocketEventError,
+		"code":    "missing_scope",
+		"message": "API key is missing the " + models.ScopeChatWrite + " scope",
+	})
+	return false
+}
+
+// markRead handles a read event sent over the messages WebSocket
+func markRead(app *config.AppConfig, userID string, event models.ClientEvent) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := controllers.MarkConversationRead(mctx, app, userID, event.Conversation_ID, event.Message_ID); err != nil {
+		log.Printf("Failed to mark conversation %s read for user %s: %v", event.Conversation_ID, userID, err)
+	}
+}
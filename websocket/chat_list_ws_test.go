@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"encoding/json"
+	"my-work/hub"
+	"my-work/models"
+	"testing"
+)
+
+func TestAllowFrame(t *testing.T) {
+	h, err := hub.New(4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		principal models.Principal
+		want      bool
+	}{
+		{"session", models.Principal{Session_ID: "s1"}, true},
+		{"key with chat:write", models.Principal{API_Key_ID: "k1", API_Key_Scopes: []string{models.ScopeChatRead, models.ScopeChatWrite}}, true},
+		{"read-only key", models.Principal{API_Key_ID: "k1", API_Key_Scopes: []string{models.ScopeChatRead}}, false},
+		{"key without scopes", models.Principal{API_Key_ID: "k1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := h.Register("u1")
+			defer h.Unregister(client)
+
+			if got := allowFrame(&tt.principal, client); got != tt.want {
+				t.Fatalf("allowFrame = %v, want %v", got, tt.want)
+			}
+			select {
+			case msg := <-client.Send():
+				if tt.want {
+					t.Fatalf("allowed frame answered with %s", msg)
+				}
+				var event struct {
+					Type string `json:"type"`
+					Code string `json:"code"`
+				}
+				if err := json.Unmarshal(msg, &event); err != nil || event.Type != models.WebSocketEventError || event.Code != "missing_scope" {
+					t.Errorf("refusal = %s", msg)
+				}
+			default:
+				if !tt.want {
+					t.Error("refused frame got no error event")
+				}
+			}
+		})
+	}
+}
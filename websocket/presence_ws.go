@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"my-work/config"
+	"my-work/controllers"
+	"my-work/hub"
+	"my-work/models"
+	"my-work/presence"
+
+	"github.com/gin-gonic/gin"
+)
+
+var presenceTracker = presence.NewTracker()
+
+// registerMu makes each registration send the tracker's latest state, so
+// concurrent changes can't leave a stale status in the PubSub backend
+var registerMu sync.Mutex
+
+func connectPresence(app *config.AppConfig, userID string, client *hub.Client) {
+	if _, changed := presenceTracker.Connect(userID, client); changed {
+		presenceChanged(app, userID)
+	}
+}
+
+func disconnectPresence(app *config.AppConfig, userID string, client *hub.Client) {
+	p, changed := presenceTracker.Disconnect(userID, client)
+	if !changed {
+		return
+	}
+	if p.Status == models.PresenceOffline {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := controllers.SaveLastSeen(mctx, app, userID, *p.Last_Seen); err != nil {
+			log.Printf("Failed to save last seen of user %s: %v", userID, err)
+		}
+	}
+	presenceChanged(app, userID)
+}
+
+// setPresence handles a presence frame, which sets the connection online or
+// away
+func setPresence(app *config.AppConfig, userID string, client *hub.Client, status string) {
+	if status != models.PresenceOnline && status != models.PresenceAway {
+		return
+	}
+	if _, changed := presenceTracker.SetAway(userID, client, status == models.PresenceAway); changed {
+		presenceChanged(app, userID)
+	}
+}
+
+// presenceChanged registers this instance's view of the user and tells their
+// chat peers the status combined across instances
+func presenceChanged(app *config.AppConfig, userID string) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	registerMu.Lock()
+	local, _ := presenceTracker.Get(userID)
+	err := app.PubSub.RegisterPresence(mctx, local)
+	registerMu.Unlock()
+	if err != nil {
+		log.Printf("Failed to register presence of user %s: %v", userID, err)
+	}
+
+	go broadcastPresence(app, userID)
+}
+
+// broadcastPresence tells the user's chat peers about a status change
+func broadcastPresence(app *config.AppConfig, userID string) {
+	mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p, err := app.PubSub.Presence(mctx, userID)
+	if err != nil {
+		log.Printf("Failed to load presence of user %s: %v", userID, err)
+		return
+	}
+	peers, err := controllers.ChatPeerIDs(mctx, app, userID)
+	if err != nil {
+		log.Printf("Failed to load chat peers of user %s: %v", userID, err)
+		return
+	}
+	event := gin.H{
+		"type":      models.WebSocketEventPresence,
+		"user_id":   p.User_ID,
+		"status":    p.Status,
+		"last_seen": p.Last_Seen,
+	}
+	for _, peer := range peers {
+		app.Hub.Publish(peer, event)
+	}
+}
+
+// relayTyping forwards a typing frame to the conversation peer once it is
+// clear the conversation exists and includes the caller, as GetPresence
+// checks. joined remembers the conversations already checked for this
+// connection. Typing state is never stored.
+func relayTyping(app *config.AppConfig, userID string, joined map[string]bool, event models.ClientEvent) {
+	peer, ok := models.ConversationPeer(event.Conversation_ID, userID)
+	if !ok || peer == userID {
+		return
+	}
+	if !joined[event.Conversation_ID] {
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		member, err := controllers.IsConversationParticipant(mctx, app, userID, event.Conversation_ID)
+		if err != nil {
+			log.Printf("Failed to check conversation %s for user %s: %v", event.Conversation_ID, userID, err)
+			return
+		}
+		if !member {
+			return
+		}
+		joined[event.Conversation_ID] = true
+	}
+	app.Hub.Publish(peer, gin.H{
+		"type":            event.Type,
+		"conversation_id": event.Conversation_ID,
+		"user_id":         userID,
+	})
+}
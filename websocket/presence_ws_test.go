@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"my-work/config"
+	"my-work/hub"
+	"my-work/models"
+	"testing"
+)
+
+func TestRelayTyping(t *testing.T) {
+	h, err := hub.New(4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No database: only conversations already in joined may reach it
+	app := &config.AppConfig{Hub: h}
+	peer := h.Register("u2")
+	defer h.Unregister(peer)
+
+	joined := map[string]bool{models.ConversationID("u1", "u2"): true}
+	tests := []struct {
+		name           string
+		conversationID string
+		relayed        bool
+	}{
+		{"joined conversation", models.ConversationID("u1", "u2"), true},
+		{"not a participant", models.ConversationID("u2", "u3"), false},
+		{"own conversation", models.ConversationID("u1", "u1"), false},
+		{"malformed id", "u2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayTyping(app, "u1", joined, models.ClientEvent{Type: models.ClientEventTypingStart, Conversation_ID: tt.conversationID})
+			select {
+			case msg := <-peer.Send():
+				if !tt.relayed {
+					t.Errorf("relayed %s", msg)
+				}
+			default:
+				if tt.relayed {
+					t.Error("typing frame not relayed")
+				}
+			}
+		})
+	}
+}